@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var cloudfrontKeyPairID string = "CLOUDFRONT_KEY_PAIR_ID"
+var cloudfrontPrivateKey string = "CLOUDFRONT_PRIVATE_KEY"
+var cloudfrontPrivateKeyFile string = "CLOUDFRONT_PRIVATE_KEY_FILE"
+var cloudfrontRestrictIP string = "CLOUDFRONT_RESTRICT_IP"
+var cloudfrontCookieDomain string = "CLOUDFRONT_COOKIE_DOMAIN"
+var trustedProxies string = "TRUSTED_PROXIES"
+
+// CloudFrontSigner issues signed URLs and cookies for a distribution that
+// restricts viewer access to a trusted key pair.
+type CloudFrontSigner struct {
+	KeyPairID  string
+	PrivateKey *rsa.PrivateKey
+}
+
+// cloudfrontSigner is nil unless a key pair is configured.
+var cloudfrontSigner = loadCloudFrontSigner()
+
+var restrictToClientIP = getEnvBool(cloudfrontRestrictIP, false)
+
+// proxyCount is how many proxies in front of us append to X-Forwarded-For.
+var proxyCount = getEnvInt(trustedProxies, 0)
+
+func loadCloudFrontSigner() *CloudFrontSigner {
+	keyPairID := os.Getenv(cloudfrontKeyPairID)
+	keyPEM := []byte(os.Getenv(cloudfrontPrivateKey))
+	if file := os.Getenv(cloudfrontPrivateKeyFile); file != "" {
+		var err error
+		keyPEM, err = ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if keyPairID == "" && len(keyPEM) == 0 {
+		return nil
+	}
+	if keyPairID == "" || len(keyPEM) == 0 {
+		log.Fatal(fmt.Sprintf("CloudFront signing needs both %s and %s (or %s).",
+			cloudfrontKeyPairID, cloudfrontPrivateKey, cloudfrontPrivateKeyFile))
+	}
+	key, err := parseRSAPrivateKey(keyPEM)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &CloudFrontSigner{KeyPairID: keyPairID, PrivateKey: key}
+}
+
+func parseRSAPrivateKey(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("cloudfront private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("cloudfront private key must be an RSA key")
+	}
+	return key, nil
+}
+
+type cloudfrontPolicy struct {
+	Statement []cloudfrontStatement `json:"Statement"`
+}
+
+type cloudfrontStatement struct {
+	Resource  string                            `json:"Resource"`
+	Condition map[string]map[string]interface{} `json:"Condition"`
+}
+
+// newCloudFrontPolicy builds a policy for resource, which may end in a "*"
+// wildcard. An empty ip leaves out the IpAddress condition, which makes
+// it equivalent to a canned policy.
+func newCloudFrontPolicy(resource string, expires time.Time, ip string) cloudfrontPolicy {
+	condition := map[string]map[string]interface{}{
+		"DateLessThan": {"AWS:EpochTime": expires.Unix()},
+	}
+	if ip != "" {
+		if strings.Contains(ip, ":") {
+			ip += "/128"
+		} else {
+			ip += "/32"
+		}
+		condition["IpAddress"] = map[string]interface{}{"AWS:SourceIp": ip}
+	}
+	return cloudfrontPolicy{Statement: []cloudfrontStatement{{Resource: resource, Condition: condition}}}
+}
+
+// marshal must not HTML-escape the resource URL: a canned policy is never
+// sent, so CloudFront rebuilds it byte for byte to check the signature.
+func (p cloudfrontPolicy) marshal() ([]byte, error) {
+	buff := new(bytes.Buffer)
+	encoder := json.NewEncoder(buff)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(p); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buff.Bytes()), nil
+}
+
+// cloudfrontEncode is base64 with the characters CloudFront cannot take
+// in query strings swapped out.
+func cloudfrontEncode(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
+
+func (cs *CloudFrontSigner) sign(policy []byte) (string, error) {
+	hash := sha1.Sum(policy)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, cs.PrivateKey, crypto.SHA1, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return cloudfrontEncode(signature), nil
+}
+
+// SignURL signs rawURL with a canned policy, or with a custom policy
+// restricted to ip when ip is not empty.
+func (cs *CloudFrontSigner) SignURL(rawURL string, expires time.Time, ip string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	policy, err := newCloudFrontPolicy(rawURL, expires, ip).marshal()
+	if err != nil {
+		return "", err
+	}
+	signature, err := cs.sign(policy)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	if ip == "" {
+		query.Set("Expires", fmt.Sprint(expires.Unix()))
+	} else {
+		query.Set("Policy", cloudfrontEncode(policy))
+	}
+	query.Set("Signature", signature)
+	query.Set("Key-Pair-Id", cs.KeyPairID)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// SignedCookies authorizes every object under resource, e.g.
+// "https://cdn.example.com/<uuid>/*", until expires. The cookies are only
+// sent for the path of resource, so those of one uuid do not replace the
+// ones of another.
+func (cs *CloudFrontSigner) SignedCookies(resource string, expires time.Time, ip string) ([]*http.Cookie, error) {
+	u, err := url.Parse(strings.TrimSuffix(resource, "*"))
+	if err != nil {
+		return nil, err
+	}
+	policy, err := newCloudFrontPolicy(resource, expires, ip).marshal()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := cs.sign(policy)
+	if err != nil {
+		return nil, err
+	}
+	domain := os.Getenv(cloudfrontCookieDomain)
+	values := [][2]string{
+		{"CloudFront-Policy", cloudfrontEncode(policy)},
+		{"CloudFront-Signature", signature},
+		{"CloudFront-Key-Pair-Id", cs.KeyPairID},
+	}
+	var cookies []*http.Cookie
+	for _, v := range values {
+		cookies = append(cookies, &http.Cookie{
+			Name:     v[0],
+			Value:    v[1],
+			Domain:   domain,
+			Path:     u.Path,
+			Expires:  expires,
+			Secure:   true,
+			HttpOnly: true,
+		})
+	}
+	return cookies, nil
+}
+
+// clientIP is the address CloudFront will see the viewer come from. Each of
+// the TRUSTED_PROXIES in front of us appends the address it was reached
+// from to X-Forwarded-For, so that is the entry as many from the end.
+// Anything before it was sent by the client and cannot be trusted.
+func clientIP(r *http.Request) string {
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	if proxyCount > 0 && len(hops) > 0 {
+		if proxyCount > len(hops) {
+			return hops[0]
+		}
+		return hops[len(hops)-proxyCount]
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func usingCloudFrontSigning() bool {
+	return cloudfrontSigner != nil && cloudfrontURL != "" && !dryRun
+}
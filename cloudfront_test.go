@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignURLCannedPolicy(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &CloudFrontSigner{KeyPairID: "APKA", PrivateKey: key}
+	expires := time.Unix(1700000000, 0)
+	signed, err := signer.SignURL("https://cdn.example.com/u/a.png?w=1&h=2", expires, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(signed)
+	query := u.Query()
+	if query.Get("Expires") != "1700000000" || query.Get("Key-Pair-Id") != "APKA" || query.Get("w") != "1" {
+		t.Errorf("got %s", signed)
+	}
+	// CloudFront rebuilds the canned policy from the unsigned URL
+	policy := fmt.Sprintf(`{"Statement":[{"Resource":"https://cdn.example.com/u/a.png?w=1&h=2",`+
+		`"Condition":{"DateLessThan":{"AWS:EpochTime":%d}}}]}`, expires.Unix())
+	decoded := strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(query.Get("Signature"))
+	signature, err := base64.StdEncoding.DecodeString(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha1.Sum([]byte(policy))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, hash[:], signature); err != nil {
+		t.Errorf("signature does not verify: %s", err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	if os.Getenv(trustedProxies) == "" && proxyCount != 0 {
+		t.Errorf("%s defaults to %d, want 0", trustedProxies, proxyCount)
+	}
+	defer func(n int) { proxyCount = n }(proxyCount)
+	for _, test := range []struct {
+		proxies   int
+		forwarded []string
+		want      string
+	}{
+		{1, nil, "192.0.2.1"},
+		{1, []string{"203.0.113.9"}, "203.0.113.9"},
+		{1, []string{"198.51.100.7, 203.0.113.9"}, "203.0.113.9"},
+		{1, []string{"198.51.100.7", "203.0.113.9"}, "203.0.113.9"},
+		{2, []string{"198.51.100.7, 203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		{3, []string{"203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		{0, []string{"198.51.100.7"}, "192.0.2.1"},
+	} {
+		proxyCount = test.proxies
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		for _, v := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != test.want {
+			t.Errorf("%d proxies, X-Forwarded-For %q: got %s, want %s", test.proxies, test.forwarded, got, test.want)
+		}
+	}
+}
+
+func TestSignedCookiesPath(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &CloudFrontSigner{KeyPairID: "APKA", PrivateKey: key}
+	cookies, err := signer.SignedCookies("https://cdn.example.com/media/0b9bd2a8/*", time.Now().Add(time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range cookies {
+		if cookie.Path != "/media/0b9bd2a8/" {
+			t.Errorf("%s has path %q", cookie.Name, cookie.Path)
+		}
+	}
+}
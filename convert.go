@@ -5,14 +5,19 @@ import (
 	"image"
 	"image/jpeg"
 	"image/png"
+	"net/http"
 )
 
-func ConvertToJpegFromPng(b []byte) []byte {
+func ConvertToJpegFromPng(b []byte) ([]byte, error) {
+	if _, err := GetImageConfigFromBytesAndType(".png", b); err != nil {
+		return nil, err
+	}
 	nr := bytes.NewReader(b)
 	buff := new(bytes.Buffer)
 	img, err := png.Decode(nr)
 	if err != nil {
-		panic(err)
+		return nil, newUploadError(http.StatusUnprocessableEntity, "invalid_image",
+			"could not decode png: %s", err.Error())
 	}
 	var rgba *image.RGBA
 	if nrgba, ok := img.(*image.NRGBA); ok {
@@ -30,7 +35,7 @@ func ConvertToJpegFromPng(b []byte) []byte {
 		err = jpeg.Encode(buff, img, &jpeg.Options{Quality: 95})
 	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return buff.Bytes()
+	return buff.Bytes(), nil
 }
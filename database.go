@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var dbMaxOpenConns string = "DB_MAX_OPEN_CONNS"
+var dbMaxIdleConns string = "DB_MAX_IDLE_CONNS"
+var dbConnMaxLifetime string = "DB_CONN_MAX_LIFETIME"
+var dbQueryTimeout string = "DB_QUERY_TIMEOUT"
+
+var queryTimeout = getEnvDuration(dbQueryTimeout, 5*time.Second)
+
+var (
+	pool     *sql.DB
+	poolOnce sync.Once
+)
+
+// getDB returns the connection pool shared by the whole process. Callers
+// must not close it.
+func getDB() *sql.DB {
+	poolOnce.Do(func() {
+		var err error
+		pool, err = sql.Open("postgres", connectionString())
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool.SetMaxOpenConns(getEnvInt(dbMaxOpenConns, 10))
+		pool.SetMaxIdleConns(getEnvInt(dbMaxIdleConns, 5))
+		pool.SetConnMaxLifetime(getEnvDuration(dbConnMaxLifetime, 30*time.Minute))
+	})
+	return pool
+}
+
+// connectionString asks Postgres to cancel statements running longer than
+// DB_QUERY_TIMEOUT. The vendored driver cannot cancel a running query when
+// its context is done, so only the server can stop it.
+func connectionString() string {
+	connstring := os.Getenv("IMAGES_POSTGRESQL_DATABASE_STRING")
+	if queryTimeout <= 0 || strings.Contains(connstring, "statement_timeout") {
+		return connstring
+	}
+	if strings.HasPrefix(connstring, "postgres://") || strings.HasPrefix(connstring, "postgresql://") {
+		converted, err := pq.ParseURL(connstring)
+		if err != nil {
+			log.Fatal(err)
+		}
+		connstring = converted
+	}
+	return connstring + " statement_timeout=" + strconv.FormatInt(int64(queryTimeout/time.Millisecond), 10)
+}
+
+// dbContext bounds a query, including the wait for a free connection, by
+// DB_QUERY_TIMEOUT.
+func dbContext() (context.Context, context.CancelFunc) {
+	if queryTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), queryTimeout)
+}
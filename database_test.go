@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnectionString(t *testing.T) {
+	defer os.Setenv("IMAGES_POSTGRESQL_DATABASE_STRING", os.Getenv("IMAGES_POSTGRESQL_DATABASE_STRING"))
+	defer func(timeout time.Duration) { queryTimeout = timeout }(queryTimeout)
+
+	queryTimeout = 2 * time.Second
+	os.Setenv("IMAGES_POSTGRESQL_DATABASE_STRING", "dbname=images sslmode=disable")
+	if got := connectionString(); got != "dbname=images sslmode=disable statement_timeout=2000" {
+		t.Errorf("keyword form: %s", got)
+	}
+	os.Setenv("IMAGES_POSTGRESQL_DATABASE_STRING", "postgres://app@db.local:5433/images?sslmode=disable")
+	got := connectionString()
+	for _, part := range []string{"host=db.local", "port=5433", "dbname=images", "user=app", "sslmode=disable", "statement_timeout=2000"} {
+		if !strings.Contains(got, part) {
+			t.Errorf("url form %s lacks %s", got, part)
+		}
+	}
+	os.Setenv("IMAGES_POSTGRESQL_DATABASE_STRING", "dbname=images statement_timeout=100")
+	if got := connectionString(); got != "dbname=images statement_timeout=100" {
+		t.Errorf("own statement_timeout replaced: %s", got)
+	}
+	queryTimeout = 0
+	os.Setenv("IMAGES_POSTGRESQL_DATABASE_STRING", "dbname=images")
+	if got := connectionString(); got != "dbname=images" {
+		t.Errorf("timeout disabled: %s", got)
+	}
+}
+
+func TestDBContext(t *testing.T) {
+	defer func(timeout time.Duration) { queryTimeout = timeout }(queryTimeout)
+
+	queryTimeout = time.Minute
+	ctx, cancel := dbContext()
+	deadline, ok := ctx.Deadline()
+	cancel()
+	if !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("deadline %v %v", deadline, ok)
+	}
+	queryTimeout = 0
+	ctx, cancel = dbContext()
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("deadline without a timeout")
+	}
+}
+
+func TestPoolSettings(t *testing.T) {
+	previous := getDB()
+	defer func() { pool = previous }()
+	defer os.Setenv(dbMaxOpenConns, os.Getenv(dbMaxOpenConns))
+	os.Setenv(dbMaxOpenConns, "3")
+
+	pool, poolOnce = nil, sync.Once{}
+	db := getDB()
+	defer db.Close()
+	if db.Stats().MaxOpenConnections != 3 {
+		t.Errorf("max open %d", db.Stats().MaxOpenConnections)
+	}
+	if getDB() != db {
+		t.Error("pool not shared")
+	}
+}
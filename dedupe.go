@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+var globalContentStore string = "GLOBAL_CONTENT_STORE"
+
+// contentPrefix is where objects live when GLOBAL_CONTENT_STORE is on, so
+// identical files uploaded under different uuids share one object.
+const contentPrefix = "content"
+
+var sharedContent = getEnvBool(globalContentStore, false)
+
+// objectSha256Header records the sha256 of the content with every object
+// storeObject writes, as S3 metadata.
+const objectSha256Header = "x-amz-meta-sha256"
+
+// sameObject compares the sha256 recorded with an object. Objects stored
+// before it was recorded are compared by ETag, which is only the md5 of
+// the content for single part uploads, and are otherwise written again.
+func sameObject(info ObjectInfo, data []byte) bool {
+	if info.Size != int64(len(data)) {
+		return false
+	}
+	if sum := info.Header.Get(objectSha256Header); sum != "" {
+		return strings.EqualFold(sum, sha256Hex(data))
+	}
+	etag := strings.Trim(info.ETag, `"`)
+	if etag == "" || strings.Contains(etag, "-") {
+		return false
+	}
+	sum := md5.Sum(data)
+	return strings.EqualFold(etag, hex.EncodeToString(sum[:]))
+}
+
+// sameDisposition is false when an existing object would be downloaded
+// under another name than the one in headers.
+func sameDisposition(info ObjectInfo, headers map[string][]string) bool {
+	want := ""
+	if v := headers["Content-Disposition"]; len(v) > 0 {
+		want = v[0]
+	}
+	return info.Header.Get("Content-Disposition") == want
+}
+
+// storeObject puts data at key unless an identical object is already
+// there. Keys end in the sha256 of their content, so an existing object
+// only differs after a partial or corrupted write. With envelope
+// encryption the object is sealed first and its envelope returned.
+func storeObject(key string, data []byte, headers map[string][]string) (bool, *Envelope, error) {
+	info, err := storage.Head(key)
+	if err != nil && err != ErrObjectNotFound {
+		fmt.Println("Could not check for existing object", key, err)
+	}
+	if encryptObjects() {
+		// every seal uses a new data key, so the ciphertext cannot be
+		// compared; an existing one is reused along with its envelope.
+		// After a rotation only the database has a usable copy of it.
+		if err == nil && sameDisposition(info, headers) {
+			if env, ok := envelopeFromHeader(info.Header); ok {
+				if !masterKeys.has(env.KeyID) {
+					env, ok = findEnvelope(key)
+				}
+				if ok && masterKeys.has(env.KeyID) {
+					return true, &env, nil
+				}
+			}
+		}
+		return storeSealedObject(key, data, headers)
+	}
+	if err == nil && sameObject(info, data) && sameDisposition(info, headers) {
+		return true, nil, nil
+	}
+	recorded := map[string][]string{objectSha256Header: {sha256Hex(data)}}
+	for k, v := range headers {
+		recorded[k] = v
+	}
+	return false, nil, ioFailure(storage.Put(key, data, recorded))
+}
+
+func storeSealedObject(key string, data []byte, headers map[string][]string) (bool, *Envelope, error) {
+	contentType := ""
+	if v := headers["Content-Type"]; len(v) > 0 {
+		contentType = v[0]
+	}
+	sealed, env, err := masterKeys.Seal(data, contentType)
+	if err != nil {
+		return false, nil, ioFailure(err)
+	}
+	sealedHeaders := make(map[string][]string)
+	for k, v := range headers {
+		sealedHeaders[k] = v
+	}
+	for k, v := range env.headers() {
+		sealedHeaders[k] = v
+	}
+	sealedHeaders["Content-Type"] = []string{"application/octet-stream"}
+	return false, &env, ioFailure(storage.Put(key, sealed, sealedHeaders))
+}
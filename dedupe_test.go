@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSameObject(t *testing.T) {
+	data := []byte("hello")
+	other := []byte("world")
+	for _, test := range []struct {
+		name string
+		info ObjectInfo
+		want bool
+	}{
+		{"same sha256", ObjectInfo{Size: 5, Header: http.Header{"X-Amz-Meta-Sha256": {sha256Hex(data)}}}, true},
+		{"other sha256", ObjectInfo{Size: 5, Header: http.Header{"X-Amz-Meta-Sha256": {sha256Hex(other)}}}, false},
+		{"other size", ObjectInfo{Size: 4, Header: http.Header{"X-Amz-Meta-Sha256": {sha256Hex(data)}}}, false},
+		{"md5 etag", ObjectInfo{Size: 5, ETag: `"5d41402abc4b2a76b9719d911017c592"`}, true},
+		{"other md5 etag", ObjectInfo{Size: 5, ETag: `"7d793037a0760186574b0282f2f435e7"`}, false},
+		{"multipart etag", ObjectInfo{Size: 5, ETag: `"5d41402abc4b2a76b9719d911017c592-2"`}, false},
+		{"no etag", ObjectInfo{Size: 5}, false},
+	} {
+		if got := sameObject(test.info, data); got != test.want {
+			t.Errorf("%s: got %v", test.name, got)
+		}
+	}
+}
+
+func TestStoreObject(t *testing.T) {
+	defer func(s Storage) { storage = s }(storage)
+	storage = NewMemoryStorage("http://localhost")
+	data := []byte("%PDF-1.4")
+	first := map[string][]string{"Content-Disposition": {contentDisposition("a.pdf")}}
+	second := map[string][]string{"Content-Disposition": {contentDisposition("b.pdf")}}
+	if deduplicated, _, err := storeObject("content/x.pdf", data, first); err != nil || deduplicated {
+		t.Fatal(deduplicated, err)
+	}
+	if info, _ := storage.Head("content/x.pdf"); info.Header.Get(objectSha256Header) != sha256Hex(data) {
+		t.Errorf("sha256 not recorded: %v", info.Header)
+	}
+	if deduplicated, _, _ := storeObject("content/x.pdf", data, first); !deduplicated {
+		t.Error("the same file under the same name was stored again")
+	}
+	if deduplicated, _, _ := storeObject("content/x.pdf", data, second); deduplicated {
+		t.Error("another name reused the object")
+	}
+	if deduplicated, _, _ := storeObject("content/x.pdf", []byte("%PDF-1.5"), second); deduplicated {
+		t.Error("other content reused the object")
+	}
+}
+
+func TestFileKeysAreKeptApart(t *testing.T) {
+	defer func(kt *KeyTemplate) { keyTemplate = kt }(keyTemplate)
+	fields := KeyFields{Uuid: "u", Sha256: "abc", Ext: "pdf", OriginalName: "report.pdf"}
+	for tmpl, want := range map[string]string{
+		defaultSharedKeyTemplate:          "u/abc/report.pdf",
+		defaultKeyTemplate:                "u/abc/report.pdf",
+		"{uuid}/{original_name}-{sha256}": "u/report-abc",
+	} {
+		keyTemplate, _ = ParseKeyTemplate("", tmpl)
+		if got := loadFileKeyTemplate().Render(fields); got != want {
+			t.Errorf("%s: got %s, want %s", tmpl, got, want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/mitchellh/goamz/s3/s3test"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dryRun is true when SKIP_S3_UPLOAD is set, in which case nothing talks
+// to AWS and every finished upload is served back by this server.
+var dryRun bool
+
+// newDryRunStorage picks the offline backend for a SKIP_S3_UPLOAD value:
+// "s3test" runs the vendored fake S3 server in process, anything else
+// truthy ("local", "true", "1") writes to LOCAL_STORAGE_DIR or a
+// directory under the system temp dir.
+func newDryRunStorage(mode string) Storage {
+	baseURL := defaultStorageBaseURL()
+	if strings.ToLower(mode) == "s3test" {
+		srv, err := s3test.NewServer(nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		region := aws.Region{Name: "s3test", S3Endpoint: srv.URL(), S3LocationConstraint: true}
+		bucketName := os.Getenv(s3Bucket)
+		if bucketName == "" {
+			bucketName = "go-flow-s3"
+		}
+		bucket := s3.New(aws.Auth{AccessKey: "dry-run", SecretKey: "dry-run"}, region).Bucket(bucketName)
+		if err := bucket.PutBucket(objectACL()); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("SKIP_S3_UPLOAD: storing files in the s3test server at", srv.URL())
+		return &proxiedStorage{Storage: NewS3Storage(bucket, objectACL(), ServerSideEncryption{}, false), baseURL: baseURL}
+	}
+	dir := os.Getenv(localStorageDir)
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "go-flow-s3")
+	}
+	ls, err := NewLocalStorage(dir, baseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("SKIP_S3_UPLOAD: storing files in", dir)
+	return ls
+}
+
+// isDryRunMode treats unset, "0" and "false" as off.
+func isDryRunMode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case "", "0", "false", "no":
+		return false
+	}
+	return true
+}
+
+// proxiedStorage serves another backend's objects through storageRoute,
+// for backends whose own URLs are not reachable by clients.
+type proxiedStorage struct {
+	Storage
+	baseURL string
+}
+
+func (ps *proxiedStorage) URL(key string) string {
+	return ps.baseURL + "/" + key
+}
+
+func (ps *proxiedStorage) SignedURL(key string, expires time.Time) string {
+	return signLocalURL(ps.baseURL, key, expires)
+}
+
+func (ps *proxiedStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveObject(ps.Storage, storageKeyFromRequest(r), w, r)
+}
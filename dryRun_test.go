@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestIsDryRunMode(t *testing.T) {
+	for mode, want := range map[string]bool{
+		"": false, "0": false, "false": false, "No": false,
+		"1": true, "true": true, "local": true, "s3test": true,
+	} {
+		if isDryRunMode(mode) != want {
+			t.Errorf("%q: want %v", mode, want)
+		}
+	}
+}
+
+// testDryRunRoundTrip stores an object and fetches it back through the
+// URL handed to clients, which has to point at this server.
+func testDryRunRoundTrip(t *testing.T, s Storage) {
+	headers := map[string][]string{"Content-Type": {"image/png"}}
+	if err := s.Put("u/a.png", []byte("png bytes"), headers); err != nil {
+		t.Fatal(err)
+	}
+	if url := s.URL("u/a.png"); url != "http://localhost:3000/storage/u/a.png" {
+		t.Errorf("url %s", url)
+	}
+	h, ok := s.(http.Handler)
+	if !ok {
+		t.Fatal("dry run storage does not serve its objects")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", storageRoute+"/u/a.png", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "png bytes" || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", storageRoute+"/u/missing.png", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing object: %d", w.Code)
+	}
+}
+
+func TestDryRunLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(localStorageDir, dir)
+	defer os.Unsetenv(localStorageDir)
+	os.Unsetenv(storageBaseURL)
+	os.Unsetenv("PORT")
+
+	testDryRunRoundTrip(t, newDryRunStorage("local"))
+	if _, err := os.Stat(dir + "/u/a.png"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDryRunS3test(t *testing.T) {
+	os.Unsetenv(storageBaseURL)
+	os.Unsetenv("PORT")
+	s := newDryRunStorage("S3TEST")
+	if _, ok := s.(*proxiedStorage); !ok {
+		t.Fatalf("got %T", s)
+	}
+	testDryRunRoundTrip(t, s)
+}
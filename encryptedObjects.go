@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/go-martini/martini"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// objectsRoute serves encrypted objects, decrypted, under
+// /<uuid>/objects/<key>.
+const objectsRoute = "/objects"
+
+// publicBaseURL is how clients reach this server, when it cannot be told
+// from the request.
+var publicBaseURL string = strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/")
+
+// requestBaseURL is how the client of r reaches this server. The proxy
+// headers nginx sets are only taken into account behind TRUSTED_PROXIES,
+// anyone could send them otherwise.
+func requestBaseURL(r *http.Request) string {
+	if publicBaseURL != "" || r == nil {
+		return publicBaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if proxyCount > 0 {
+		if proto := forwardedHeader(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwarded := forwardedHeader(r, "X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+	}
+	return scheme + "://" + host
+}
+
+// forwardedHeader is the value the outermost trusted proxy set for name,
+// when several of them append to it.
+func forwardedHeader(r *http.Request, name string) string {
+	values := strings.Split(r.Header.Get(name), ",")
+	if proxyCount < len(values) {
+		values = values[len(values)-proxyCount:]
+	}
+	return strings.TrimSpace(values[0])
+}
+
+// decryptingURL points at objectsRoute, since the stored object is
+// ciphertext. Like storage URLs they are signed when objects are private.
+func decryptingURL(uuidv4, key string, r *http.Request) (string, time.Time) {
+	base := requestBaseURL(r) + "/" + uuidv4 + objectsRoute
+	if !privateObjects {
+		return base + "/" + key, time.Time{}
+	}
+	expires := time.Now().Add(urlExpiry)
+	return signLocalURL(base, key, expires), expires
+}
+
+// getEnvelope looks up the envelope of key among the uploads of uuidv4, so
+// only objects that belong to uuidv4 can be decrypted through it.
+func getEnvelope(uuidv4, key string) (Envelope, bool) {
+	return queryEnvelope(`select metadata -> 'envelopes' -> $2 from images
+		where uuid = $1 and metadata -> 'envelopes' ? $2 limit 1`, uuidv4, key)
+}
+
+// findEnvelope looks up the envelope of key under any uuid, for objects
+// shared through GLOBAL_CONTENT_STORE.
+func findEnvelope(key string) (Envelope, bool) {
+	return queryEnvelope(`select metadata -> 'envelopes' -> $1 from images
+		where metadata -> 'envelopes' ? $1 limit 1`, key)
+}
+
+func queryEnvelope(query string, args ...interface{}) (Envelope, bool) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	var envelope []byte
+	err := getDB().QueryRowContext(ctx, query, args...).Scan(&envelope)
+	if err == sql.ErrNoRows {
+		return Envelope{}, false
+	}
+	if err != nil {
+		panic(ioFailure(err))
+	}
+	var env Envelope
+	if err := json.Unmarshal(envelope, &env); err != nil {
+		panic(err.Error())
+	}
+	return env, true
+}
+
+func serveDecrypted(params martini.Params, w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Recovered in decrypt", r)
+			http.Error(w, "Could not decrypt object", http.StatusInternalServerError)
+		}
+	}()
+	uuidv4 := params["uuidv4"]
+	key := strings.TrimPrefix(r.URL.Path, "/"+uuidv4+objectsRoute+"/")
+	if privateObjects && !checkLocalSignature(key, r) {
+		http.Error(w, "URL expired or not signed", http.StatusForbidden)
+		return
+	}
+	env, ok := getEnvelope(uuidv4, key)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	body, info, err := storage.Get(key)
+	if err == ErrObjectNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	defer body.Close()
+	sealed, err := ioutil.ReadAll(body)
+	if err != nil {
+		panic(err)
+	}
+	plaintext, err := masterKeys.Open(sealed, env)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", env.ContentType)
+	if disposition := info.Header.Get("Content-Disposition"); disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	if privateObjects {
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(urlExpiry/time.Second)))
+	} else {
+		w.Header().Set("Cache-Control", "max-age=31536000")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(plaintext)))
+	if r.Method != "HEAD" {
+		w.Write(plaintext)
+	}
+}
+
+// rotateEnvelopeKeys rewraps every data key that is not under the active
+// master key. Only the database is updated: objects keep the envelope they
+// were written with, and the database copy is the one that is used.
+func rotateEnvelopeKeys() {
+	if !encryptObjects() {
+		fmt.Println("Set", envelopeMasterKeys, "to rotate keys")
+		os.Exit(1)
+	}
+	db := getDB()
+	rows, err := db.Query(`select uuid, url, metadata from images where metadata ? 'envelopes'`)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer rows.Close()
+	type record struct {
+		uuid, url string
+		metadata  []byte
+	}
+	var records []record
+	for rows.Next() {
+		var rec record
+		if err := rows.Scan(&rec.uuid, &rec.url, &rec.metadata); err != nil {
+			panic(err.Error())
+		}
+		records = append(records, rec)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err.Error())
+	}
+	rows.Close()
+	rewrapped, failed := 0, 0
+	for _, rec := range records {
+		var metadata map[string]json.RawMessage
+		var envelopes map[string]Envelope
+		if err := json.Unmarshal(rec.metadata, &metadata); err != nil {
+			panic(err.Error())
+		}
+		if err := json.Unmarshal(metadata["envelopes"], &envelopes); err != nil {
+			panic(err.Error())
+		}
+		changed := false
+		for key, env := range envelopes {
+			newEnv, ok, err := masterKeys.Rewrap(env)
+			if err != nil {
+				fmt.Println("Could not rewrap", rec.uuid, key, err)
+				failed++
+				continue
+			}
+			if ok {
+				envelopes[key] = newEnv
+				changed = true
+				rewrapped++
+			}
+		}
+		if !changed {
+			continue
+		}
+		metadata["envelopes"], _ = json.Marshal(envelopes)
+		updated, _ := json.Marshal(metadata)
+		if _, err := db.Exec("update images set metadata = $1 where uuid = $2 and url = $3",
+			string(updated), rec.uuid, rec.url); err != nil {
+			panic(err.Error())
+		}
+	}
+	fmt.Println("Rewrapped", rewrapped, "data keys under", masterKeys.Active)
+	if failed > 0 {
+		fmt.Println(failed, "data keys could not be rewrapped")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var envelopeMasterKeys string = "ENVELOPE_MASTER_KEYS"
+var envelopeActiveKeyID string = "ENVELOPE_ACTIVE_KEY_ID"
+
+const envelopeAlgorithm = "AES-256-GCM"
+
+var errUnknownMasterKey = errors.New("object was encrypted under a master key that is not configured")
+
+// Envelope is what it takes to decrypt an object: the data key, wrapped
+// by the master key KeyID, and the content type of the plaintext.
+type Envelope struct {
+	KeyID       string `json:"key_id"`
+	WrappedKey  string `json:"wrapped_key"`
+	ContentType string `json:"content_type"`
+}
+
+// MasterKeys wrap the per-object data keys. New objects use Active, the
+// others are kept to unwrap data keys that have not been rotated yet.
+type MasterKeys struct {
+	Active string
+	keys   map[string][]byte
+}
+
+// masterKeys is nil unless ENVELOPE_MASTER_KEYS is set, in which case
+// every object is encrypted before it leaves this server.
+var masterKeys = loadMasterKeys()
+
+func loadMasterKeys() *MasterKeys {
+	spec := os.Getenv(envelopeMasterKeys)
+	if spec == "" {
+		return nil
+	}
+	mk, err := ParseMasterKeys(spec, os.Getenv(envelopeActiveKeyID))
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid %s: %s", envelopeMasterKeys, err.Error()))
+	}
+	return mk
+}
+
+// ParseMasterKeys reads "id:base64key,id2:base64key" with 256 bit keys.
+// active defaults to the first key listed.
+func ParseMasterKeys(spec, active string) (*MasterKeys, error) {
+	mk := &MasterKeys{Active: active, keys: make(map[string][]byte)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not id:base64key", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be a base64 encoded 256 bit key", parts[0])
+		}
+		if _, ok := mk.keys[parts[0]]; ok {
+			return nil, fmt.Errorf("key %q is listed twice", parts[0])
+		}
+		mk.keys[parts[0]] = key
+		if mk.Active == "" {
+			mk.Active = parts[0]
+		}
+	}
+	if _, ok := mk.keys[mk.Active]; !ok {
+		return nil, fmt.Errorf("active key %q is not listed", mk.Active)
+	}
+	return mk, nil
+}
+
+func (mk *MasterKeys) has(keyID string) bool {
+	_, ok := mk.keys[keyID]
+	return ok
+}
+
+func encryptObjects() bool {
+	return masterKeys != nil
+}
+
+// gcmSeal returns nonce || ciphertext.
+func gcmSeal(key, plaintext, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func gcmOpen(key, sealed, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], additional)
+}
+
+// wrap seals dataKey under the active master key. The key ID is
+// authenticated too, so a wrapped key cannot be passed off as another's.
+func (mk *MasterKeys) wrap(dataKey []byte) (Envelope, error) {
+	wrapped, err := gcmSeal(mk.keys[mk.Active], dataKey, []byte(mk.Active))
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{KeyID: mk.Active, WrappedKey: base64.StdEncoding.EncodeToString(wrapped)}, nil
+}
+
+func (mk *MasterKeys) unwrap(env Envelope) ([]byte, error) {
+	master, ok := mk.keys[env.KeyID]
+	if !ok {
+		return nil, errUnknownMasterKey
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(env.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(master, wrapped, []byte(env.KeyID))
+}
+
+// Seal encrypts plaintext under a fresh data key.
+func (mk *MasterKeys) Seal(plaintext []byte, contentType string) ([]byte, Envelope, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, Envelope{}, err
+	}
+	sealed, err := gcmSeal(dataKey, plaintext, nil)
+	if err != nil {
+		return nil, Envelope{}, err
+	}
+	env, err := mk.wrap(dataKey)
+	if err != nil {
+		return nil, Envelope{}, err
+	}
+	env.ContentType = contentType
+	return sealed, env, nil
+}
+
+func (mk *MasterKeys) Open(sealed []byte, env Envelope) ([]byte, error) {
+	dataKey, err := mk.unwrap(env)
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(dataKey, sealed, nil)
+}
+
+// Rewrap moves env to the active master key. The object itself is left
+// alone, only the wrapped data key changes. It reports false when env was
+// already under the active key.
+func (mk *MasterKeys) Rewrap(env Envelope) (Envelope, bool, error) {
+	if env.KeyID == mk.Active {
+		return env, false, nil
+	}
+	dataKey, err := mk.unwrap(env)
+	if err != nil {
+		return env, false, err
+	}
+	rewrapped, err := mk.wrap(dataKey)
+	if err != nil {
+		return env, false, err
+	}
+	rewrapped.ContentType = env.ContentType
+	return rewrapped, true, nil
+}
+
+// headers record env on the object as well, next to the ciphertext.
+func (env Envelope) headers() map[string][]string {
+	return map[string][]string{
+		"x-amz-meta-envelope-algorithm":    {envelopeAlgorithm},
+		"x-amz-meta-envelope-key-id":       {env.KeyID},
+		"x-amz-meta-envelope-wrapped-key":  {env.WrappedKey},
+		"x-amz-meta-envelope-content-type": {env.ContentType},
+	}
+}
+
+func envelopeFromHeader(header http.Header) (Envelope, bool) {
+	if header.Get("X-Amz-Meta-Envelope-Algorithm") != envelopeAlgorithm {
+		return Envelope{}, false
+	}
+	env := Envelope{
+		KeyID:       header.Get("X-Amz-Meta-Envelope-Key-Id"),
+		WrappedKey:  header.Get("X-Amz-Meta-Envelope-Wrapped-Key"),
+		ContentType: header.Get("X-Amz-Meta-Envelope-Content-Type"),
+	}
+	return env, env.KeyID != "" && env.WrappedKey != ""
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testMasterKey(t *testing.T) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestParseMasterKeys(t *testing.T) {
+	a, b := testMasterKey(t), testMasterKey(t)
+	mk, err := ParseMasterKeys("new:"+a+", old:"+b, "")
+	if err != nil || mk.Active != "new" || !mk.has("old") {
+		t.Fatal(mk, err)
+	}
+	if mk, err := ParseMasterKeys("new:"+a+",old:"+b, "old"); err != nil || mk.Active != "old" {
+		t.Error(mk, err)
+	}
+	for _, spec := range []string{
+		"",
+		"new",
+		":" + a,
+		"new:" + a + ",new:" + b,
+		"short:" + base64.StdEncoding.EncodeToString([]byte("0123456789")),
+		"new:not base64",
+	} {
+		if _, err := ParseMasterKeys(spec, ""); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+	if _, err := ParseMasterKeys("new:"+a, "missing"); err == nil {
+		t.Error("unlisted active key accepted")
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	mk, err := ParseMasterKeys("k1:"+testMasterKey(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("%PDF-1.4 secret")
+	sealed, env, err := mk.Seal(plaintext, "application/pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plaintext) || env.KeyID != "k1" || env.ContentType != "application/pdf" {
+		t.Fatalf("sealed %q under %+v", sealed, env)
+	}
+	opened, err := mk.Open(sealed, env)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("opened %q, %v", opened, err)
+	}
+
+	header := http.Header{}
+	for k, v := range env.headers() {
+		header[http.CanonicalHeaderKey(k)] = v
+	}
+	if fromHeader, ok := envelopeFromHeader(header); !ok || fromHeader != env {
+		t.Errorf("header round trip: %+v %v", fromHeader, ok)
+	}
+	if _, ok := envelopeFromHeader(http.Header{}); ok {
+		t.Error("envelope found without headers")
+	}
+}
+
+func TestEnvelopeRotation(t *testing.T) {
+	oldKey, newKey := testMasterKey(t), testMasterKey(t)
+	before, _ := ParseMasterKeys("old:"+oldKey, "")
+	plaintext := []byte("rotate me")
+	sealed, env, err := before.Seal(plaintext, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, _ := ParseMasterKeys("new:"+newKey+",old:"+oldKey, "")
+	rewrapped, changed, err := after.Rewrap(env)
+	if err != nil || !changed || rewrapped.KeyID != "new" || rewrapped.ContentType != "text/plain" {
+		t.Fatalf("rewrap: %+v %v %v", rewrapped, changed, err)
+	}
+	if again, changed, err := after.Rewrap(rewrapped); err != nil || changed || again != rewrapped {
+		t.Errorf("rewrapping the active key: %+v %v %v", again, changed, err)
+	}
+
+	// the object is untouched, only the new master key is needed for it
+	retired, _ := ParseMasterKeys("new:"+newKey, "")
+	if opened, err := retired.Open(sealed, rewrapped); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("after rotation: %q %v", opened, err)
+	}
+	if _, err := retired.Open(sealed, env); err != errUnknownMasterKey {
+		t.Errorf("old envelope after removing its key: %v", err)
+	}
+}
+
+func TestEnvelopeWrongKey(t *testing.T) {
+	mk, _ := ParseMasterKeys("k1:"+testMasterKey(t), "")
+	other, _ := ParseMasterKeys("k1:"+testMasterKey(t), "")
+	sealed, env, err := mk.Seal([]byte("secret"), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Open(sealed, env); err == nil {
+		t.Error("opened under another master key with the same id")
+	}
+	if _, _, err := other.Rewrap(Envelope{KeyID: "k2", WrappedKey: env.WrappedKey}); err != errUnknownMasterKey {
+		t.Errorf("rewrap of an unknown key: %v", err)
+	}
+}
+
+func TestEnvelopeTamper(t *testing.T) {
+	a, b := testMasterKey(t), testMasterKey(t)
+	mk, _ := ParseMasterKeys("a:"+a+",b:"+b, "")
+	sealed, env, err := mk.Seal([]byte("secret"), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)-1] ^= 1
+	if _, err := mk.Open(flipped, env); err == nil {
+		t.Error("opened tampered ciphertext")
+	}
+	if _, err := mk.Open(sealed[:4], env); err == nil {
+		t.Error("opened truncated ciphertext")
+	}
+
+	wrapped, _ := base64.StdEncoding.DecodeString(env.WrappedKey)
+	wrapped[len(wrapped)-1] ^= 1
+	tampered := env
+	tampered.WrappedKey = base64.StdEncoding.EncodeToString(wrapped)
+	if _, err := mk.Open(sealed, tampered); err == nil {
+		t.Error("opened with a tampered wrapped key")
+	}
+
+	// the key id is authenticated, a wrapped key cannot claim another one
+	relabeled := env
+	relabeled.KeyID = "b"
+	if _, err := mk.Open(sealed, relabeled); err == nil {
+		t.Error("opened with a relabeled key id")
+	}
+}
+
+func TestRequestBaseURL(t *testing.T) {
+	defer func(base string, proxies int) { publicBaseURL, proxyCount = base, proxies }(publicBaseURL, proxyCount)
+	r := httptest.NewRequest("GET", "http://uploads.local/u", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "evil.example.com, uploads.example.com")
+
+	publicBaseURL, proxyCount = "", 0
+	if base := requestBaseURL(r); base != "http://uploads.local" {
+		t.Errorf("without trusted proxies: %s", base)
+	}
+	proxyCount = 1
+	if base := requestBaseURL(r); base != "https://uploads.example.com" {
+		t.Errorf("behind one proxy: %s", base)
+	}
+	publicBaseURL = "https://cdn.example.com"
+	if base := requestBaseURL(r); base != publicBaseURL {
+		t.Errorf("with a public base: %s", base)
+	}
+	if base := requestBaseURL(nil); base != publicBaseURL {
+		t.Errorf("without a request: %s", base)
+	}
+}
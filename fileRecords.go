@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-martini/martini"
+	"github.com/nu7hatch/gouuid"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conversions applied before storing, recorded with each file.
+const (
+	conversionPngToJpeg    = "png_to_jpeg"
+	conversionSanitizedSvg = "svg_sanitized"
+)
+
+// maxFileLimit caps the page size of file listings.
+const maxFileLimit = 1000
+
+// defaultFileLimit is the page size of /:uuidv4/files. /:uuidv4/urls is
+// not paginated unless asked to, as before.
+const defaultFileLimit = 100
+
+// fileSortColumns are the columns listings can be sorted by. Each has an
+// index on (uuid, column, id), see migrations.go.
+var fileSortColumns = map[string]string{
+	"created_at": "timestamptz",
+	"size":       "bigint",
+	"width":      "bigint",
+	"height":     "bigint",
+}
+
+// FileQuery selects a page of the files of a uuid. The zero value is every
+// file, oldest first.
+type FileQuery struct {
+	Limit         int
+	After         *fileCursor
+	Sort          string
+	Desc          bool
+	MimeType      string
+	MinWidth      *int
+	MaxWidth      *int
+	MinHeight     *int
+	MaxHeight     *int
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// fileCursor is the position after the last file of a page: its sort value
+// and id, which breaks ties. It is handed out base64 encoded and only valid
+// with the sort it was made for.
+type fileCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func (c fileCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseFileCursor(s string) (*fileCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c fileCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if _, ok := fileSortColumns[c.Sort]; !ok {
+		return nil, errors.New("unknown cursor")
+	}
+	// checked here so that a forged cursor is a bad request rather than a
+	// failed cast in the query
+	id, err := uuid.ParseHex(c.ID)
+	if err != nil {
+		return nil, err
+	}
+	c.ID = id.String()
+	if c.Sort == "created_at" {
+		_, err = time.Parse(time.RFC3339Nano, c.Value)
+	} else {
+		_, err = strconv.ParseInt(c.Value, 10, 64)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// likeEscaper makes a string match itself in a like pattern with escape '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func invalidQuery(format string, a ...interface{}) *uploadError {
+	return newUploadError(http.StatusBadRequest, "invalid_query", format, a...)
+}
+
+// parseFileQuery reads limit, after, sort, order, mime_type, min_width,
+// max_width, min_height, max_height, created_after and created_before.
+// A mime_type ending in /* matches the whole type, e.g. image/*.
+func parseFileQuery(values url.Values, defaultLimit int) (FileQuery, error) {
+	query := FileQuery{Limit: defaultLimit, Sort: "created_at"}
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxFileLimit {
+			return query, invalidQuery("limit must be between 1 and %d", maxFileLimit)
+		}
+		query.Limit = limit
+	}
+	if v := values.Get("sort"); v != "" {
+		if _, ok := fileSortColumns[v]; !ok {
+			return query, invalidQuery("sort must be created_at, size, width or height")
+		}
+		query.Sort = v
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		return query, invalidQuery("order must be asc or desc")
+	}
+	if v := values.Get("after"); v != "" {
+		cursor, err := parseFileCursor(v)
+		if err != nil {
+			return query, invalidQuery("after is not a cursor from this listing")
+		}
+		if cursor.Sort != query.Sort || cursor.Desc != query.Desc {
+			return query, invalidQuery("after is a cursor for another sort order")
+		}
+		query.After = cursor
+	}
+	query.MimeType = values.Get("mime_type")
+	for name, bound := range map[string]**int{
+		"min_width":  &query.MinWidth,
+		"max_width":  &query.MaxWidth,
+		"min_height": &query.MinHeight,
+		"max_height": &query.MaxHeight,
+	} {
+		if v := values.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return query, invalidQuery("%s must be a number of pixels", name)
+			}
+			*bound = &n
+		}
+	}
+	for name, bound := range map[string]*time.Time{
+		"created_after":  &query.CreatedAfter,
+		"created_before": &query.CreatedBefore,
+	} {
+		if v := values.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return query, invalidQuery("%s must be a time such as 2016-01-02T15:04:05Z", name)
+			}
+			*bound = t
+		}
+	}
+	return query, nil
+}
+
+// narrowed reports whether query can leave out files of the uuid, in which
+// case an empty result is not a missing uuid.
+func (query FileQuery) narrowed() bool {
+	return query.After != nil || query.MimeType != "" || query.MinWidth != nil ||
+		query.MaxWidth != nil || query.MinHeight != nil || query.MaxHeight != nil ||
+		!query.CreatedAfter.IsZero() || !query.CreatedBefore.IsZero()
+}
+
+// sql returns the conditions and order of query, with its arguments
+// numbered after uuid, which is $1.
+func (query FileQuery) sql() (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args)+1)
+	}
+	if query.MimeType != "" {
+		if strings.HasSuffix(query.MimeType, "/*") {
+			prefix := likeEscaper.Replace(strings.TrimSuffix(query.MimeType, "*"))
+			where = append(where, "mime_type like "+arg(prefix+"%")+` escape '\'`)
+		} else {
+			where = append(where, "mime_type = "+arg(query.MimeType))
+		}
+	}
+	for condition, bound := range map[string]*int{
+		"width >= ":  query.MinWidth,
+		"width <= ":  query.MaxWidth,
+		"height >= ": query.MinHeight,
+		"height <= ": query.MaxHeight,
+	} {
+		if bound != nil {
+			where = append(where, condition+arg(*bound))
+		}
+	}
+	if !query.CreatedAfter.IsZero() {
+		where = append(where, "created_at >= "+arg(query.CreatedAfter))
+	}
+	if !query.CreatedBefore.IsZero() {
+		where = append(where, "created_at < "+arg(query.CreatedBefore))
+	}
+	direction, after := "asc", ">"
+	if query.Desc {
+		direction, after = "desc", "<"
+	}
+	if query.After != nil {
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s::%s, %s::uuid)", query.Sort, after,
+			arg(query.After.Value), fileSortColumns[query.Sort], arg(query.After.ID)))
+	}
+	sort.Strings(where)
+	clause := ""
+	for _, condition := range where {
+		clause += " and " + condition
+	}
+	clause += fmt.Sprintf(" order by %s %s, id %s", query.Sort, direction, direction)
+	if query.Limit > 0 {
+		// one more tells whether there is a next page
+		clause += " limit " + arg(query.Limit+1)
+	}
+	return clause, args
+}
+
+// cursorAfter is the cursor of the page following imageData.
+func (query FileQuery) cursorAfter(imageData ImageData) string {
+	value := ""
+	switch query.Sort {
+	case "created_at":
+		value = imageData.CreatedAt.Format(time.RFC3339Nano)
+	case "size":
+		value = strconv.FormatInt(imageData.Size, 10)
+	case "width":
+		value = strconv.Itoa(imageData.Width)
+	case "height":
+		value = strconv.Itoa(imageData.Height)
+	}
+	return fileCursor{Sort: query.Sort, Desc: query.Desc, Value: value, ID: imageData.ID}.String()
+}
+
+// fileRecords returns a page of the stored files of uuidv4 and the cursor
+// of the next one, which is empty after the last page.
+func fileRecords(uuidv4 string, query FileQuery) ([]ImageData, string, error) {
+	if query.Sort == "" {
+		query.Sort = "created_at"
+	}
+	clause, args := query.sql()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := getDB().QueryContext(ctx, `select id, kind, url, height, width, original_name, size,
+		mime_type, sha256, conversion, metadata, created_at from images
+		where uuid = $1`+clause, append([]interface{}{uuidv4}, args...)...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	files := []ImageData{}
+	for rows.Next() {
+		imageData := ImageData{Uuid: uuidv4}
+		var metadata []byte
+		var createdAt time.Time
+		err := rows.Scan(&imageData.ID, &imageData.Kind, &imageData.Url, &imageData.Height,
+			&imageData.Width, &imageData.OriginalName, &imageData.Size, &imageData.MimeType,
+			&imageData.Sha256, &imageData.Conversion, &metadata, &createdAt)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := imageData.restoreMetadata(metadata); err != nil {
+			return nil, "", err
+		}
+		imageData.CreatedAt = &createdAt
+		files = append(files, imageData)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if query.Limit > 0 && len(files) > query.Limit {
+		files = files[:query.Limit]
+		next = query.cursorAfter(files[len(files)-1])
+	}
+	return files, next, nil
+}
+
+// setNextLink points clients at the page after the one served for r.
+func setNextLink(w http.ResponseWriter, r *http.Request, next string) {
+	if next == "" {
+		return
+	}
+	values := r.URL.Query()
+	values.Set("after", next)
+	w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, values.Encode()))
+}
+
+// getFiles lists the files of a uuid with everything known about them,
+// where /:uuidv4/urls only has the URLs.
+func getFiles(params martini.Params, w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Recovered in file listing", r)
+			http.Error(w, "Could not list files", http.StatusInternalServerError)
+		}
+	}()
+	query, err := parseFileQuery(r.URL.Query(), defaultFileLimit)
+	if err != nil {
+		err.(*uploadError).write(w)
+		return
+	}
+	files, next, err := fileRecords(params["uuidv4"], query)
+	if err != nil {
+		panic(err.Error())
+	}
+	if len(files) == 0 && !query.narrowed() {
+		http.Error(w, "Files not found", http.StatusNotFound)
+		return
+	}
+	for i := range files {
+		setObjectURLs(&files[i], r)
+	}
+	setNextLink(w, r, next)
+	w.Header().Set("Content-Type", "application/json")
+	body, err := json.Marshal(struct {
+		Files []ImageData `json:"files"`
+		Next  string      `json:"next,omitempty"`
+	}{files, next})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(body)
+}
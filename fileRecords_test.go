@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-martini/martini"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoredMetadataRoundTrip(t *testing.T) {
+	if metadata := (ImageData{Kind: "image", Width: 10}).probeMetadata(); metadata != nil {
+		t.Errorf("metadata %v for a plain image", metadata)
+	}
+	stored := ImageData{Frames: 12, DurationMs: 480, PosterUrl: "u1/poster.jpeg",
+		Pdf:       &PdfInfo{Pages: 3},
+		Envelopes: map[string]Envelope{"u1/a.pdf": {KeyID: "k1", WrappedKey: "d3JhcHBlZA=="}}}
+	var restored ImageData
+	if err := restored.restoreMetadata([]byte(stored.probeMetadata().(string))); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Frames != 12 || restored.DurationMs != 480 || restored.PosterUrl != "u1/poster.jpeg" ||
+		restored.Pdf == nil || restored.Pdf.Pages != 3 || restored.Envelopes["u1/a.pdf"].KeyID != "k1" {
+		t.Errorf("restored %+v", restored)
+	}
+	if !restored.Encrypted {
+		t.Error("file with envelopes not marked encrypted")
+	}
+	if err := restored.restoreMetadata(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVideoURLPattern(t *testing.T) {
+	pattern := regexp.MustCompile(videoURLPattern())
+	for url, video := range map[string]bool{
+		"u1/abc.mp4":  true,
+		"u1/abc.mov":  true,
+		"u1/abc.m4v":  true,
+		"u1/abc.jpeg": false,
+		"u1/mp4.pdf":  false,
+		"u1/abcxmp4":  false,
+	} {
+		if pattern.MatchString(url) != video {
+			t.Errorf("%s: video %v", url, !video)
+		}
+	}
+}
+
+func TestFileRecords(t *testing.T) {
+	db, drop := openTestSchema(t)
+	defer drop()
+	if _, err := migrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	previous := getDB()
+	pool = db
+	defer func() { pool = previous }()
+	defer func(s Storage, private bool) { storage, privateObjects = s, private }(storage, privateObjects)
+	storage = NewMemoryStorage("http://localhost/storage")
+	privateObjects = false
+
+	uuidv4 := "5f4dcc3b-5aa7-4d61-9d32-1b5b5c6d7e8f"
+	first := ImageData{Uuid: uuidv4, Url: uuidv4 + "/a.jpeg", Kind: "image", Width: 20, Height: 10,
+		OriginalName: "a.png", Size: 2048, MimeType: "image/jpeg", Sha256: "a", Conversion: conversionPngToJpeg}
+	if err := storeAttributes(&first); err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == "" || first.CreatedAt == nil {
+		t.Fatalf("stored %+v", first)
+	}
+	again := first
+	again.OriginalName = "again.png"
+	if err := storeAttributes(&again); err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID || !again.CreatedAt.Equal(*first.CreatedAt) {
+		t.Errorf("storing again changed id or created_at: %+v", again)
+	}
+	second := ImageData{Uuid: uuidv4, Url: uuidv4 + "/b.pdf", Kind: "file", OriginalName: "b.pdf",
+		Size: 9, MimeType: "application/pdf", Sha256: "b", Pdf: &PdfInfo{Pages: 2}}
+	if err := storeAttributes(&second); err != nil {
+		t.Fatal(err)
+	}
+
+	files, next, err := fileRecords(uuidv4, FileQuery{})
+	if err != nil || next != "" {
+		t.Fatal(next, err)
+	}
+	if len(files) != 2 || files[0].ID != first.ID || files[1].ID != second.ID {
+		t.Fatalf("files %+v", files)
+	}
+	if f := files[0]; f.OriginalName != "again.png" || f.Size != 2048 || f.Conversion != conversionPngToJpeg ||
+		f.Width != 20 || f.MimeType != "image/jpeg" {
+		t.Errorf("first file %+v", f)
+	}
+	if f := files[1]; f.Pdf == nil || f.Pdf.Pages != 2 {
+		t.Errorf("second file %+v", f)
+	}
+
+	w := httptest.NewRecorder()
+	getFiles(martini.Params{"uuidv4": uuidv4}, w, httptest.NewRequest("GET", "/"+uuidv4+"/files", nil))
+	var body struct {
+		Files []ImageData `json:"files"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, %v", w.Code, err)
+	}
+	if len(body.Files) != 2 || body.Files[0].Url != "http://localhost/storage/"+uuidv4+"/a.jpeg" {
+		t.Errorf("listed %+v", body.Files)
+	}
+
+	page, next, err := fileRecords(uuidv4, FileQuery{Sort: "size", Desc: true, Limit: 1})
+	if err != nil || len(page) != 1 || page[0].ID != first.ID || next == "" {
+		t.Fatalf("first page %+v %q %v", page, next, err)
+	}
+	after, err := parseFileCursor(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, next, err = fileRecords(uuidv4, FileQuery{Sort: "size", Desc: true, Limit: 1, After: after})
+	if err != nil || len(page) != 1 || page[0].ID != second.ID || next != "" {
+		t.Errorf("second page %+v %q %v", page, next, err)
+	}
+	page, _, err = fileRecords(uuidv4, FileQuery{Sort: "created_at", MimeType: "image/*"})
+	if err != nil || len(page) != 1 || page[0].ID != first.ID {
+		t.Errorf("image/* %+v %v", page, err)
+	}
+	page, _, err = fileRecords(uuidv4, FileQuery{Sort: "created_at", MimeType: "image_jpeg/*"})
+	if err != nil || len(page) != 0 {
+		t.Errorf("_ matched as a wildcard: %+v %v", page, err)
+	}
+
+	w = httptest.NewRecorder()
+	getFiles(martini.Params{"uuidv4": uuidv4}, w, httptest.NewRequest("GET", "/"+uuidv4+"/files?min_width=100", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"files":[]`) {
+		t.Errorf("filtered out: %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	other := "00000000-0000-4000-8000-000000000000"
+	getFiles(martini.Params{"uuidv4": other}, w, httptest.NewRequest("GET", "/"+other+"/files", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("uuid without files: %d", w.Code)
+	}
+}
+
+func TestParseFileQuery(t *testing.T) {
+	cursor := fileCursor{Sort: "size", Desc: true, Value: "42", ID: "0b9bd2a8-4e4b-4d4e-8f0a-2b7b9d1f6c3e"}.String()
+	ten, twenty := 10, 20
+	for _, test := range []struct {
+		query string
+		want  FileQuery
+		ok    bool
+	}{
+		{"", FileQuery{Limit: 100, Sort: "created_at"}, true},
+		{"limit=5&sort=width&order=desc", FileQuery{Limit: 5, Sort: "width", Desc: true}, true},
+		{"mime_type=image/*&min_width=10&max_height=20", FileQuery{Limit: 100, Sort: "created_at",
+			MimeType: "image/*", MinWidth: &ten, MaxHeight: &twenty}, true},
+		{"created_after=2016-01-02T15:04:05Z", FileQuery{Limit: 100, Sort: "created_at",
+			CreatedAfter: time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)}, true},
+		{"sort=size&order=desc&after=" + cursor, FileQuery{Limit: 100, Sort: "size", Desc: true,
+			After: &fileCursor{Sort: "size", Desc: true, Value: "42", ID: "0b9bd2a8-4e4b-4d4e-8f0a-2b7b9d1f6c3e"}}, true},
+		{"limit=0", FileQuery{}, false},
+		{"limit=1001", FileQuery{}, false},
+		{"limit=ten", FileQuery{}, false},
+		{"sort=name", FileQuery{}, false},
+		{"order=up", FileQuery{}, false},
+		{"min_width=-1", FileQuery{}, false},
+		{"created_before=yesterday", FileQuery{}, false},
+		{"after=not-a-cursor", FileQuery{}, false},
+		{"after=" + cursor, FileQuery{}, false},
+	} {
+		values, _ := url.ParseQuery(test.query)
+		got, err := parseFileQuery(values, 100)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: error %v", test.query, err)
+			continue
+		}
+		if err != nil {
+			if ue, ok := err.(*uploadError); !ok || ue.Status != 400 {
+				t.Errorf("%q: got %v, want a 400", test.query, err)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestFileQuerySQL(t *testing.T) {
+	five := 5
+	after := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		query  FileQuery
+		clause string
+		args   []interface{}
+	}{
+		{FileQuery{Sort: "created_at"}, " order by created_at asc, id asc", nil},
+		{FileQuery{Sort: "size", Desc: true, Limit: 10}, " order by size desc, id desc limit $2", []interface{}{11}},
+		{FileQuery{Sort: "created_at", MimeType: "image/png"},
+			" and mime_type = $2 order by created_at asc, id asc", []interface{}{"image/png"}},
+		{FileQuery{Sort: "created_at", MimeType: "image/*"},
+			` and mime_type like $2 escape '\' order by created_at asc, id asc`, []interface{}{"image/%"}},
+		{FileQuery{Sort: "created_at", MimeType: `a_b%c\d/*`},
+			` and mime_type like $2 escape '\' order by created_at asc, id asc`, []interface{}{`a\_b\%c\\d/%`}},
+		{FileQuery{Sort: "width", MinWidth: &five, CreatedAfter: after},
+			" and created_at >= $3 and width >= $2 order by width asc, id asc", []interface{}{5, after}},
+		{FileQuery{Sort: "width", After: &fileCursor{Sort: "width", Value: "640", ID: "x"}, Limit: 2},
+			" and (width, id) > ($2::bigint, $3::uuid) order by width asc, id asc limit $4", []interface{}{"640", "x", 3}},
+		{FileQuery{Sort: "size", Desc: true, After: &fileCursor{Sort: "size", Desc: true, Value: "9", ID: "y"}},
+			" and (size, id) < ($2::bigint, $3::uuid) order by size desc, id desc", []interface{}{"9", "y"}},
+	} {
+		clause, args := test.query.sql()
+		if clause != test.clause || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%+v:\ngot  %q %v\nwant %q %v", test.query, clause, args, test.clause, test.args)
+		}
+	}
+}
+
+func TestFileCursorRoundTrip(t *testing.T) {
+	created := time.Date(2016, 1, 2, 15, 4, 5, 123456789, time.UTC)
+	file := ImageData{ID: "0b9bd2a8-4e4b-4d4e-8f0a-2b7b9d1f6c3e", Size: 2048, Width: 640, Height: 480, CreatedAt: &created}
+	for sort, value := range map[string]string{
+		"created_at": "2016-01-02T15:04:05.123456789Z",
+		"size":       "2048",
+		"width":      "640",
+		"height":     "480",
+	} {
+		for _, desc := range []bool{false, true} {
+			query := FileQuery{Sort: sort, Desc: desc}
+			cursor, err := parseFileCursor(query.cursorAfter(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := fileCursor{Sort: sort, Desc: desc, Value: value, ID: file.ID}
+			if *cursor != want {
+				t.Errorf("got %+v, want %+v", *cursor, want)
+			}
+		}
+	}
+	if _, err := parseFileCursor(fileCursor{Sort: "name", ID: "x"}.String()); err == nil {
+		t.Error("a cursor for an unknown sort was accepted")
+	}
+}
+
+func TestParseFileCursorValues(t *testing.T) {
+	id := "0b9bd2a8-4e4b-4d4e-8f0a-2b7b9d1f6c3e"
+	for _, c := range []fileCursor{
+		{Sort: "size", Value: "42"},
+		{Sort: "size", Value: "42", ID: "x"},
+		{Sort: "size", Value: "42", ID: id + "'"},
+		{Sort: "size", Value: "4.2", ID: id},
+		{Sort: "width", Value: "wide", ID: id},
+		{Sort: "height", Value: "", ID: id},
+		{Sort: "created_at", Value: "42", ID: id},
+		{Sort: "created_at", Value: "2016-01-02", ID: id},
+	} {
+		if _, err := parseFileCursor(c.String()); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+		values := url.Values{"sort": {c.Sort}, "after": {c.String()}}
+		if _, err := parseFileQuery(values, 100); err == nil || err.(*uploadError).Status != http.StatusBadRequest {
+			t.Errorf("%+v: %v, want a 400", c, err)
+		}
+	}
+	c, err := parseFileCursor(fileCursor{Sort: "created_at", Value: "2016-01-02T15:04:05+02:00",
+		ID: "{" + id + "}"}.String())
+	if err != nil || c.ID != id {
+		t.Errorf("got %+v, %v", c, err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	kindImage = "image"
+	kindVideo = "video"
+	kindFile  = "file"
+)
+
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+func isImageExtension(ext string) bool {
+	return imageExtensions[ext]
+}
+
+func sha256Hex(b []byte) string {
+	hash := sha256.New()
+	hash.Write(b)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// detectMimeType sniffs the content first and only falls back to the
+// extension when sniffing gives a generic answer, since flow.js clients
+// send whatever filename the user picked.
+func detectMimeType(fileExt string, b []byte) string {
+	detected := http.DetectContentType(b)
+	byExt := mime.TypeByExtension(fileExt)
+	if byExt == "" {
+		return detected
+	}
+	if strings.HasPrefix(detected, "application/octet-stream") || strings.HasPrefix(detected, "text/plain") {
+		return byExt
+	}
+	return detected
+}
+
+func contentDisposition(fileName string) string {
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": fileName})
+	if disposition == "" {
+		return "attachment"
+	}
+	return disposition
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDetectMimeType(t *testing.T) {
+	for _, c := range []struct {
+		ext, want string
+		body      []byte
+	}{
+		{".pdf", "application/pdf", []byte("%PDF-1.4\n")},
+		{".txt", "application/pdf", []byte("%PDF-1.4\n")},
+		{".json", "application/json", []byte(`{"a": 1}`)},
+		{"", "text/plain; charset=utf-8", []byte("a,b\n1,2\n")},
+		{".bin", "application/octet-stream", []byte{0, 1, 2, 3}},
+	} {
+		if got := detectMimeType(c.ext, c.body); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.ext, got, c.want)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	if got := contentDisposition("report.pdf"); got != "attachment; filename=report.pdf" {
+		t.Errorf("got %q", got)
+	}
+	if got := contentDisposition("a \"quoted\" name.pdf"); got != `attachment; filename="a \"quoted\" name.pdf"` {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestIsImageExtension(t *testing.T) {
+	for ext, want := range map[string]bool{".png": true, ".gif": true, ".pdf": false, "": false} {
+		if isImageExtension(ext) != want {
+			t.Errorf("%q: want %v", ext, want)
+		}
+	}
+	if got := sha256Hex(nil); got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("got %s", got)
+	}
+}
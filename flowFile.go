@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
@@ -9,27 +10,74 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type FlowFile struct {
-	name string
+	name    string
+	started time.Time
 }
 
+// startedBucket records when the first chunk of each flow file was saved,
+// next to the chunk buckets which are named after their uuid.
+var startedBucket = []byte("_started")
+
+// ImageData describes a finished upload. Kind is "image" or "video" for
+// files that were probed for dimensions and "file" for everything else, in
+// which case Height and Width are always zero.
 type ImageData struct {
-	Url    string `json:"url"`
-	Uuid   string `json:"uuid"`
-	Height int    `json:"height"`
-	Width  int    `json:"width"`
+	ID           string     `json:"id,omitempty"`
+	Kind         string     `json:"kind"`
+	Url          string     `json:"url"`
+	Uuid         string     `json:"uuid"`
+	Height       int        `json:"height"`
+	Width        int        `json:"width"`
+	OriginalName string     `json:"original_name"`
+	Size         int64      `json:"size"`
+	MimeType     string     `json:"mime_type"`
+	Sha256       string     `json:"sha256"`
+	Conversion   string     `json:"conversion,omitempty"`
+	Deduplicated bool       `json:"deduplicated"`
+	UrlExpiresAt string     `json:"url_expires_at,omitempty"`
+	Frames       int        `json:"frames,omitempty"`
+	DurationMs   int64      `json:"duration_ms,omitempty"`
+	PosterUrl    string     `json:"poster_url,omitempty"`
+	Pdf          *PdfInfo   `json:"pdf,omitempty"`
+	Video        *VideoInfo `json:"video,omitempty"`
+	Svg          *SvgInfo   `json:"svg,omitempty"`
+	Encrypted    bool       `json:"encrypted,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+
+	// Envelopes holds the wrapped data key of each encrypted object,
+	// by key. It is only kept in the database.
+	Envelopes map[string]Envelope `json:"-"`
+}
+
+// addEnvelope records the envelope storeObject returned for key, if any.
+func (id *ImageData) addEnvelope(key string, env *Envelope) {
+	if env == nil {
+		return
+	}
+	if id.Envelopes == nil {
+		id.Envelopes = make(map[string]Envelope)
+	}
+	id.Envelopes[key] = *env
+	id.Encrypted = true
 }
 
 func CreateFlowFile(params martini.Params, r *http.Request) *FlowFile {
-	return &FlowFile{params["uuidv4"] + r.FormValue("flowIdentifier")}
+	return &FlowFile{name: params["uuidv4"] + r.FormValue("flowIdentifier")}
 }
 
 func (ff *FlowFile) getBolt() *bolt.DB {
+	return openBolt()
+}
+
+func openBolt() *bolt.DB {
 	db, err := bolt.Open(os.Getenv(boltChunks), 0600, nil)
 	if err != nil {
-		panic(fmt.Sprintf("Bolt Open Error %s", err.Error()))
+		panic(ioFailure(fmt.Errorf("Bolt Open Error %s", err.Error())))
 	}
 	return db
 }
@@ -62,11 +110,21 @@ func (ff *FlowFile) SaveChunkBytes(r *http.Request, chunkBytes []byte) {
 		if err != nil {
 			return err
 		}
+		started, err := tx.CreateBucketIfNotExists(startedBucket)
+		if err != nil {
+			return err
+		}
+		if started.Get([]byte(ff.name)) == nil {
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			if err := started.Put([]byte(ff.name), []byte(now)); err != nil {
+				return err
+			}
+		}
 		err = bucket.Put([]byte(ff.getChunkNum(r)), chunkBytes)
 		return err
 	})
 	if err != nil {
-		panic(err)
+		panic(ioFailure(err))
 	}
 }
 
@@ -83,7 +141,7 @@ func (ff *FlowFile) NumberOfChunks() int {
 		return nil
 	})
 	if err != nil {
-		panic(err)
+		panic(ioFailure(err))
 	}
 	return numKeys
 }
@@ -106,7 +164,7 @@ func (ff *FlowFile) AssembleChunks() []byte {
 		return nil
 	})
 	if err != nil {
-		panic(err)
+		panic(ioFailure(err))
 	}
 	buff := new(bytes.Buffer)
 	for _, b := range chunks {
@@ -118,17 +176,101 @@ func (ff *FlowFile) AssembleChunks() []byte {
 	return buff.Bytes()
 }
 
+// StartedAt is when the first chunk was saved. Object keys take their date
+// from it rather than from when the upload is finished, which can be on
+// another day after a retry.
+func (ff *FlowFile) StartedAt() time.Time {
+	if !ff.started.IsZero() {
+		return ff.started
+	}
+	db := ff.getBolt()
+	defer db.Close()
+	err := db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(startedBucket); bucket != nil {
+			if v := bucket.Get([]byte(ff.name)); v != nil {
+				ff.started, _ = time.Parse(time.RFC3339Nano, string(v))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(ioFailure(err))
+	}
+	if ff.started.IsZero() {
+		// chunks saved before start times were recorded
+		ff.started = time.Now()
+	}
+	return ff.started
+}
+
+func (ff *FlowFile) FileName(r *http.Request) string {
+	return filepath.Base(r.FormValue("flowFilename"))
+}
+
 func (ff *FlowFile) FileExtension(r *http.Request) string {
-	return filepath.Ext(r.FormValue("flowFilename"))
+	return fileExtension(r.FormValue("flowFilename"))
+}
+
+// fileExtension is the lower cased extension of name, including the dot.
+func fileExtension(name string) string {
+	return strings.ToLower(filepath.Ext(name))
 }
 
 func (ff *FlowFile) Delete() {
 	db := ff.getBolt()
 	defer db.Close()
 	err := db.Update(func(tx *bolt.Tx) error {
+		if started := tx.Bucket(startedBucket); started != nil {
+			if err := started.Delete([]byte(ff.name)); err != nil {
+				return err
+			}
+		}
 		return tx.DeleteBucket([]byte(ff.name))
 	})
+	if err != nil {
+		panic(ioFailure(err))
+	}
+}
+
+// storedMetadata is what the metadata column holds: the details that have
+// no column of their own.
+type storedMetadata struct {
+	Pdf        *PdfInfo            `json:"pdf,omitempty"`
+	Video      *VideoInfo          `json:"video,omitempty"`
+	Svg        *SvgInfo            `json:"svg,omitempty"`
+	Envelopes  map[string]Envelope `json:"envelopes,omitempty"`
+	Frames     int                 `json:"frames,omitempty"`
+	DurationMs int64               `json:"duration_ms,omitempty"`
+	PosterUrl  string              `json:"poster_url,omitempty"`
+}
+
+// probeMetadata returns the format specific probe results that have no
+// column of their own, as JSON for the metadata column, or nil when there
+// are none.
+func (id ImageData) probeMetadata() interface{} {
+	metadata := storedMetadata{id.Pdf, id.Video, id.Svg, id.Envelopes, id.Frames, id.DurationMs, id.PosterUrl}
+	b, err := json.Marshal(metadata)
 	if err != nil {
 		panic(err)
 	}
+	if string(b) == "{}" {
+		return nil
+	}
+	return string(b)
+}
+
+// restoreMetadata fills in id from a metadata column written by
+// probeMetadata.
+func (id *ImageData) restoreMetadata(column []byte) error {
+	if column == nil {
+		return nil
+	}
+	var metadata storedMetadata
+	if err := json.Unmarshal(column, &metadata); err != nil {
+		return err
+	}
+	id.Pdf, id.Video, id.Svg, id.Envelopes = metadata.Pdf, metadata.Video, metadata.Svg, metadata.Envelopes
+	id.Frames, id.DurationMs, id.PosterUrl = metadata.Frames, metadata.DurationMs, metadata.PosterUrl
+	id.Encrypted = len(metadata.Envelopes) > 0
+	return nil
 }
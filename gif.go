@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"net/http"
+	"time"
+)
+
+var gifPoster string = "GIF_POSTER"
+var maxGifFrames string = "MAX_GIF_FRAMES"
+var maxGifDuration string = "MAX_GIF_DURATION"
+var maxGifMegapixels string = "MAX_GIF_MEGAPIXELS"
+
+// GifPolicy limits animations. MaxMegapixels is the sum over all frames,
+// which is what decoding them takes in memory at a byte per pixel.
+type GifPolicy struct {
+	Poster        bool
+	MaxFrames     int
+	MaxDuration   time.Duration
+	MaxMegapixels float64
+}
+
+var gifPolicy = GifPolicy{
+	Poster:        getEnvBool(gifPoster, false),
+	MaxFrames:     getEnvInt(maxGifFrames, 1000),
+	MaxDuration:   getEnvDuration(maxGifDuration, 0),
+	MaxMegapixels: getEnvFloat(maxGifMegapixels, 100),
+}
+
+type GifInfo struct {
+	Frames   int
+	Duration time.Duration
+	Pixels   int64
+	gif      *gif.GIF
+}
+
+func getImageConfigFromGifBytes(b []byte) (image.Config, error) {
+	return gif.DecodeConfig(bytes.NewReader(b))
+}
+
+// InspectGif counts the frames, delays and pixels of a gif from its block
+// structure and checks them against gifPolicy before decoding anything, as
+// every frame is allocated in full by the decoder.
+func InspectGif(b []byte) (GifInfo, error) {
+	info, err := scanGif(b)
+	if err != nil {
+		return GifInfo{}, newUploadError(http.StatusUnprocessableEntity, "invalid_image",
+			"could not read gif: %s", err.Error())
+	}
+	if err := gifPolicy.Check(info); err != nil {
+		return GifInfo{}, err
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(b))
+	if err != nil {
+		return GifInfo{}, newUploadError(http.StatusUnprocessableEntity, "invalid_image",
+			"could not decode gif: %s", err.Error())
+	}
+	info.gif = g
+	return info, nil
+}
+
+var errGifTruncated = errors.New("unexpected end of data")
+
+// scanGif walks the blocks of a gif without decompressing them. Delays are
+// taken from the graphic control extension before each image, which only
+// applies to that image, as image/gif does.
+func scanGif(b []byte) (GifInfo, error) {
+	var info GifInfo
+	if len(b) < 13 || (string(b[:6]) != "GIF87a" && string(b[:6]) != "GIF89a") {
+		return info, errors.New("not a gif")
+	}
+	pos := 13
+	if b[10]&0x80 != 0 {
+		pos += 3 << (uint(b[10]&7) + 1)
+	}
+	var delay time.Duration
+	for {
+		if pos >= len(b) {
+			return info, errGifTruncated
+		}
+		switch b[pos] {
+		case 0x21:
+			if pos+1 >= len(b) {
+				return info, errGifTruncated
+			}
+			label := b[pos+1]
+			pos += 2
+			// graphic control: size 4, flags, delay, transparent index
+			if label == 0xF9 && pos+4 < len(b) && b[pos] == 4 {
+				// gif delays are in hundredths of a second
+				delay = time.Duration(int(b[pos+2])|int(b[pos+3])<<8) * 10 * time.Millisecond
+			}
+			next, err := skipGifSubBlocks(b, pos)
+			if err != nil {
+				return info, err
+			}
+			pos = next
+		case 0x2C:
+			if pos+10 > len(b) {
+				return info, errGifTruncated
+			}
+			width := int64(b[pos+5]) | int64(b[pos+6])<<8
+			height := int64(b[pos+7]) | int64(b[pos+8])<<8
+			flags := b[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (uint(flags&7) + 1)
+			}
+			// the LZW minimum code size comes before the data
+			next, err := skipGifSubBlocks(b, pos+1)
+			if err != nil {
+				return info, err
+			}
+			pos = next
+			info.Frames++
+			info.Pixels += width * height
+			info.Duration += delay
+			delay = 0
+		case 0x3B:
+			return info, nil
+		default:
+			return info, fmt.Errorf("unknown block 0x%02x", b[pos])
+		}
+	}
+}
+
+// skipGifSubBlocks returns the position after the sub-blocks starting at
+// pos and their terminator.
+func skipGifSubBlocks(b []byte, pos int) (int, error) {
+	for {
+		if pos >= len(b) {
+			return pos, errGifTruncated
+		}
+		size := int(b[pos])
+		pos++
+		if size == 0 {
+			return pos, nil
+		}
+		pos += size
+	}
+}
+
+func (p GifPolicy) Check(info GifInfo) error {
+	if p.MaxFrames > 0 && info.Frames > p.MaxFrames {
+		return newUploadError(http.StatusRequestEntityTooLarge, "animation_too_many_frames",
+			"gif has %d frames, the limit is %d", info.Frames, p.MaxFrames)
+	}
+	if p.MaxDuration > 0 && info.Duration > p.MaxDuration {
+		return newUploadError(http.StatusRequestEntityTooLarge, "animation_too_long",
+			"gif runs for %s, the limit is %s", info.Duration, p.MaxDuration)
+	}
+	megapixels := float64(info.Pixels) / 1e6
+	if p.MaxMegapixels > 0 && megapixels > p.MaxMegapixels {
+		return newUploadError(http.StatusRequestEntityTooLarge, "animation_too_many_pixels",
+			"gif frames add up to %.1f megapixels, the limit is %.1f", megapixels, p.MaxMegapixels)
+	}
+	return nil
+}
+
+// Poster renders the first frame onto a white canvas the size of the gif
+// and encodes it as a JPEG.
+func (info GifInfo) Poster() ([]byte, error) {
+	if len(info.gif.Image) == 0 {
+		return nil, newUploadError(http.StatusUnprocessableEntity, "invalid_image", "gif has no frames")
+	}
+	bounds := image.Rect(0, 0, info.gif.Config.Width, info.gif.Config.Height)
+	if bounds.Empty() {
+		bounds = info.gif.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, &image.Uniform{color.White}, image.Point{}, draw.Src)
+	frame := info.gif.Image[0]
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	buff := new(bytes.Buffer)
+	if err := jpeg.Encode(buff, canvas, &jpeg.Options{Quality: 95}); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
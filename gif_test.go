@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+	"time"
+)
+
+func encodeGif(t *testing.T, frames int, size int, delay int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, size, size), palette.Plan9))
+		g.Delay = append(g.Delay, delay)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// hugeGif declares frames of width x height without any pixel data, which
+// is all it takes to make gif.DecodeAll allocate them.
+func hugeGif(frames, width, height int) []byte {
+	le := func(n int) []byte { return []byte{byte(n), byte(n >> 8)} }
+	b := []byte("GIF89a")
+	b = append(b, le(width)...)
+	b = append(b, le(height)...)
+	b = append(b, 0, 0, 0)
+	for i := 0; i < frames; i++ {
+		b = append(b, 0x2C, 0, 0, 0, 0)
+		b = append(b, le(width)...)
+		b = append(b, le(height)...)
+		b = append(b, 0, 8, 0)
+	}
+	return append(b, 0x3B)
+}
+
+func TestInspectGif(t *testing.T) {
+	info, err := InspectGif(encodeGif(t, 3, 10, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Frames != 3 || info.Duration != 210*time.Millisecond || info.Pixels != 300 {
+		t.Errorf("got %+v", info)
+	}
+	if len(info.gif.Image) != 3 {
+		t.Errorf("decoded %d frames", len(info.gif.Image))
+	}
+}
+
+func TestScanGifMalformed(t *testing.T) {
+	valid := encodeGif(t, 2, 4, 0)
+	for name, b := range map[string][]byte{
+		"empty":      nil,
+		"not a gif":  []byte("PNG89a-------"),
+		"truncated":  valid[:len(valid)-8],
+		"no trailer": valid[:len(valid)-1],
+		"bad block":  append(append([]byte{}, valid[:len(valid)-1]...), 0x99),
+	} {
+		if _, err := scanGif(b); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestInspectGifRejectsPixelsBeforeDecoding(t *testing.T) {
+	_, err := InspectGif(hugeGif(20, 4000, 4000))
+	ue, ok := err.(*uploadError)
+	if !ok || ue.Code != "animation_too_many_pixels" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestGifPolicyFrames(t *testing.T) {
+	policy := GifPolicy{MaxFrames: 2}
+	if err := policy.Check(GifInfo{Frames: 3}); err == nil {
+		t.Error("3 frames passed a limit of 2")
+	}
+	if err := policy.Check(GifInfo{Frames: 2}); err != nil {
+		t.Error(err)
+	}
+}
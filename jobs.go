@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/go-martini/martini"
+	"github.com/nu7hatch/gouuid"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var finalizeWorkers string = "FINALIZE_WORKERS"
+var jobRetention string = "JOB_RETENTION"
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// jobsBucket holds the finalization jobs, next to the chunk buckets which
+// are named after their uuid.
+var jobsBucket = []byte("_jobs")
+
+// workerCount is the number of finalization workers. With none, the last
+// chunk is finalized within its own request as before.
+var workerCount = getEnvInt(finalizeWorkers, 0)
+
+var jobsKeptFor = getEnvDuration(jobRetention, 24*time.Hour)
+
+var jobQueue = make(chan string, 1024)
+
+// enqueueLock keeps two last chunks arriving together from queueing the
+// same flow file twice.
+var enqueueLock sync.Mutex
+
+// Job is the finalization of one uploaded file. It is persisted in Bolt so
+// queued and interrupted jobs are picked up again after a restart.
+type Job struct {
+	ID        string       `json:"id"`
+	Uuid      string       `json:"uuid"`
+	FlowFile  string       `json:"flow_file"`
+	FileName  string       `json:"file_name"`
+	State     string       `json:"state"`
+	Attempts  int          `json:"attempts"`
+	Error     *uploadError `json:"error,omitempty"`
+	Retryable bool         `json:"retryable,omitempty"`
+	Result    *ImageData   `json:"result,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+func asyncFinalize() bool {
+	return workerCount > 0
+}
+
+func saveJob(job *Job) {
+	job.UpdatedAt = time.Now()
+	body, err := json.Marshal(job)
+	if err != nil {
+		panic(err)
+	}
+	db := openBolt()
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(jobsBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(job.ID), body)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func getJob(id string) (*Job, bool) {
+	var job *Job
+	db := openBolt()
+	defer db.Close()
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		if bucket == nil {
+			return nil
+		}
+		body := bucket.Get([]byte(id))
+		if body == nil {
+			return nil
+		}
+		job = &Job{}
+		return json.Unmarshal(body, job)
+	})
+	if err != nil {
+		panic(err)
+	}
+	return job, job != nil
+}
+
+// eachJob calls fn with every stored job.
+func eachJob(fn func(*Job)) {
+	var jobs []*Job
+	db := openBolt()
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			job := &Job{}
+			if err := json.Unmarshal(v, job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	db.Close()
+	if err != nil {
+		panic(err)
+	}
+	for _, job := range jobs {
+		fn(job)
+	}
+}
+
+func deleteJob(id string) {
+	db := openBolt()
+	defer db.Close()
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(jobsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(id))
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// enqueueFinalize queues ff for a worker and returns its job. A flow file
+// that is already queued or running keeps its job, since flow.js resends
+// the last chunk when it does not hear back in time.
+func enqueueFinalize(ff *FlowFile, uuidv4, name string) *Job {
+	enqueueLock.Lock()
+	defer enqueueLock.Unlock()
+	var pending *Job
+	eachJob(func(job *Job) {
+		if job.FlowFile == ff.name && (job.State == jobQueued || job.State == jobRunning) {
+			pending = job
+		}
+	})
+	if pending != nil {
+		return pending
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		panic(err)
+	}
+	job := &Job{
+		ID:        id.String(),
+		Uuid:      uuidv4,
+		FlowFile:  ff.name,
+		FileName:  name,
+		State:     jobQueued,
+		CreatedAt: time.Now(),
+	}
+	saveJob(job)
+	go func() { jobQueue <- job.ID }()
+	return job
+}
+
+// startFinalizeWorkers runs the worker pool and requeues the jobs that
+// were queued or running when the server last stopped.
+func startFinalizeWorkers() {
+	for i := 0; i < workerCount; i++ {
+		go finalizeWorker()
+	}
+	go eachJob(func(job *Job) {
+		if job.State == jobQueued || job.State == jobRunning {
+			jobQueue <- job.ID
+		}
+	})
+	go pruneJobs()
+}
+
+func finalizeWorker() {
+	for id := range jobQueue {
+		job, ok := getJob(id)
+		if !ok || job.State == jobDone || job.State == jobFailed {
+			continue
+		}
+		runJob(job)
+	}
+}
+
+func runJob(job *Job) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Recovered in job", job.ID, r)
+		}
+	}()
+	job.State = jobRunning
+	job.Attempts++
+	saveJob(job)
+	ff := &FlowFile{name: job.FlowFile}
+	imageData, err := finalizeFlowFile(ff, job.Uuid, job.FileName)
+	notifyFinalized(job.Uuid, job.FileName, imageData, err)
+	switch {
+	case err == nil:
+		ff.Delete()
+		job.State = jobDone
+		job.Result = &imageData
+	case !retryable(err):
+		ff.Delete()
+		job.State = jobFailed
+		job.Error = asUploadError(err)
+	default:
+		// chunks stay, resending the last one starts a new job
+		fmt.Println("Could not finalize upload, keeping chunks", err)
+		job.State = jobFailed
+		job.Retryable = true
+		job.Error = newUploadError(http.StatusServiceUnavailable, "finalize_failed",
+			"The upload could not be stored, send the last chunk again to retry")
+	}
+	saveJob(job)
+}
+
+func asUploadError(err error) *uploadError {
+	if ue, ok := err.(*uploadError); ok {
+		return ue
+	}
+	return newUploadError(http.StatusInternalServerError, "finalize_failed", "%s", err.Error())
+}
+
+// pruneJobs forgets finished jobs after JOB_RETENTION.
+func pruneJobs() {
+	for {
+		eachJob(func(job *Job) {
+			finished := job.State == jobDone || job.State == jobFailed
+			if finished && time.Since(job.UpdatedAt) > jobsKeptFor {
+				deleteJob(job.ID)
+			}
+		})
+		time.Sleep(time.Hour)
+	}
+}
+
+func writeJobAccepted(w http.ResponseWriter, job *Job) {
+	statusURL := "/" + job.Uuid + "/jobs/" + job.ID
+	w.Header().Set("Location", statusURL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	body, _ := json.Marshal(map[string]string{
+		"job_id":     job.ID,
+		"status_url": statusURL,
+	})
+	w.Write(body)
+}
+
+// getJobStatus reports a job, with the URLs of a finished upload made for
+// the client asking, so signed ones are fresh.
+func getJobStatus(params martini.Params, w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Recovered in job status", r)
+		}
+	}()
+	job, ok := getJob(params["id"])
+	if !ok || job.Uuid != params["uuidv4"] {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if job.Result != nil {
+		setObjectURLs(job.Result, r)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// the empty FlowFile hides the internal chunk bucket name
+	body, err := json.Marshal(struct {
+		*Job
+		FlowFile string `json:"flow_file,omitempty"`
+	}{Job: job})
+	if err != nil {
+		panic(err)
+	}
+	w.Write(body)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-martini/martini"
+	"github.com/mitchellh/goamz/aws"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withChunkStore points BOLT_CHUNKS at a fresh database for the test.
+func withChunkStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := os.Getenv(boltChunks)
+	os.Setenv(boltChunks, filepath.Join(dir, "chunks.db"))
+	return func() {
+		os.Setenv(boltChunks, previous)
+		os.RemoveAll(dir)
+	}
+}
+
+func saveTestChunk(t *testing.T, ff *FlowFile, chunk []byte) {
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Form = url.Values{"flowChunkNumber": {"1"}}
+	ff.SaveChunkBytes(r, chunk)
+}
+
+func TestEnqueueFinalizeKeepsPendingJob(t *testing.T) {
+	defer withChunkStore(t)()
+	ff := &FlowFile{name: "u1f1"}
+	first := enqueueFinalize(ff, "u1", "a.png")
+	if first.State != jobQueued {
+		t.Fatalf("state %s", first.State)
+	}
+	if again := enqueueFinalize(ff, "u1", "a.png"); again.ID != first.ID {
+		t.Errorf("resent last chunk queued job %s next to %s", again.ID, first.ID)
+	}
+	if other := enqueueFinalize(&FlowFile{name: "u1f2"}, "u1", "b.png"); other.ID == first.ID {
+		t.Error("another file shares the job")
+	}
+
+	first.State = jobFailed
+	saveJob(first)
+	if retry := enqueueFinalize(ff, "u1", "a.png"); retry.ID == first.ID || retry.State != jobQueued {
+		t.Errorf("failed job was not replaced: %+v", retry)
+	}
+}
+
+func TestRunJobInvalidUpload(t *testing.T) {
+	defer withChunkStore(t)()
+	ff := &FlowFile{name: "u1f1"}
+	saveTestChunk(t, ff, []byte("not a png"))
+	job := enqueueFinalize(ff, "u1", "a.png")
+
+	runJob(job)
+	stored, ok := getJob(job.ID)
+	if !ok || stored.State != jobFailed || stored.Retryable || stored.Attempts != 1 {
+		t.Fatalf("got %+v", stored)
+	}
+	if stored.Error == nil || stored.Error.Code == "" {
+		t.Errorf("no error reported: %+v", stored.Error)
+	}
+	if n := ff.NumberOfChunks(); n != 0 {
+		t.Errorf("%d chunks kept for an upload that cannot succeed", n)
+	}
+}
+
+func TestRunJobStorageFailureKeepsChunks(t *testing.T) {
+	defer withChunkStore(t)()
+	defer func(s Storage, attempts aws.AttemptStrategy) { storage, finalizeAttempts = s, attempts }(storage, finalizeAttempts)
+	defer withoutDatabase()()
+	storage = NewMemoryStorage("http://localhost/storage")
+	finalizeAttempts = aws.AttemptStrategy{Delay: time.Millisecond, Min: 1}
+	// the database write fails
+
+	ff := &FlowFile{name: "u1f1"}
+	saveTestChunk(t, ff, []byte("%PDF-1.4\n"))
+	job := enqueueFinalize(ff, "u1", "a.txt")
+
+	runJob(job)
+	stored, _ := getJob(job.ID)
+	if stored.State != jobFailed || !stored.Retryable || stored.Error.Code != "finalize_failed" {
+		t.Fatalf("got %+v", stored)
+	}
+	if n := ff.NumberOfChunks(); n != 1 {
+		t.Errorf("%d chunks kept, the last one could not be resent", n)
+	}
+}
+
+func TestGetJobStatus(t *testing.T) {
+	defer withChunkStore(t)()
+	defer func(s Storage, private bool) { storage, privateObjects = s, private }(storage, privateObjects)
+	storage = NewMemoryStorage("http://localhost/storage")
+	privateObjects = true
+
+	uuidv4 := "5f4dcc3b-5aa7-4d61-9d32-1b5b5c6d7e8f"
+	job := &Job{ID: "j1", Uuid: uuidv4, FlowFile: uuidv4 + "f1", State: jobDone,
+		Result: &ImageData{Uuid: uuidv4, Url: uuidv4 + "/a.png"}}
+	saveJob(job)
+
+	get := func(uuidv4, id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/"+uuidv4+"/jobs/"+id, nil)
+		getJobStatus(martini.Params{"uuidv4": uuidv4, "id": id}, w, r)
+		return w
+	}
+	w := get(uuidv4, "j1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["flow_file"]; ok {
+		t.Error("chunk bucket name leaked")
+	}
+	result := body["result"].(map[string]interface{})
+	signed, _ := url.Parse(result["url"].(string))
+	if !checkLocalSignature(uuidv4+"/a.png", httptest.NewRequest("GET", signed.RequestURI(), nil)) {
+		t.Errorf("result url %s is not signed", signed)
+	}
+	if result["url_expires_at"] == nil {
+		t.Error("no expiry for a signed url")
+	}
+
+	if w := get("00000000-0000-4000-8000-000000000000", "j1"); w.Code != http.StatusNotFound {
+		t.Errorf("job of another uuid: %d", w.Code)
+	}
+	if w := get(uuidv4, "missing"); w.Code != http.StatusNotFound {
+		t.Errorf("missing job: %d", w.Code)
+	}
+}
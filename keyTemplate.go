@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var objectKeyTemplate string = "OBJECT_KEY_TEMPLATE"
+var objectKeyPrefix string = "OBJECT_KEY_PREFIX"
+
+const (
+	defaultKeyTemplate       = "{uuid}/{sha256}.{ext}"
+	defaultSharedKeyTemplate = contentPrefix + "/{sha256}.{ext}"
+	defaultFileKeyTemplate   = "{uuid}/{sha256}/{original_name}.{ext}"
+)
+
+const (
+	presetOriginal = "original"
+	presetPoster   = "poster"
+)
+
+// KeyFields are the values a KeyTemplate can refer to. Ext has no leading
+// dot and Preset names the variant of an upload, e.g. "original" or
+// "poster".
+type KeyFields struct {
+	Uuid         string
+	Sha256       string
+	Ext          string
+	Preset       string
+	OriginalName string
+	Time         time.Time
+}
+
+type keyPart struct {
+	literal     string
+	placeholder string
+	start, end  int
+}
+
+// KeyTemplate renders object keys such as "{uuid}/{sha256}.{ext}". The
+// placeholders are {uuid}, {sha256}, {sha256:start:end} for a slice of the
+// digest, {ext}, {yyyy}, {mm}, {dd}, {preset} and {original_name}.
+type KeyTemplate struct {
+	prefix string
+	parts  []keyPart
+}
+
+var keyPlaceholder = regexp.MustCompile(`\{([a-z0-9_]+)(?::(\d+):(\d+))?\}`)
+
+var keyPlaceholders = map[string]bool{
+	"uuid":          true,
+	"sha256":        true,
+	"ext":           true,
+	"yyyy":          true,
+	"mm":            true,
+	"dd":            true,
+	"preset":        true,
+	"original_name": true,
+}
+
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+var keyTemplate = loadKeyTemplate()
+
+// fileKeyTemplate lays out the keys of downloads, which are served with a
+// Content-Disposition naming the file as it was uploaded. Unless every key
+// has the uuid and name in it they get keys of their own, so that the same
+// file uploaded elsewhere under another name gets an object of its own.
+var fileKeyTemplate = loadFileKeyTemplate()
+
+func loadKeyTemplate() *KeyTemplate {
+	tmpl := os.Getenv(objectKeyTemplate)
+	if tmpl == "" {
+		tmpl = defaultKeyTemplate
+		if sharedContent {
+			tmpl = defaultSharedKeyTemplate
+		}
+	}
+	kt, err := ParseKeyTemplate(os.Getenv(objectKeyPrefix), tmpl)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid %s: %s", objectKeyTemplate, err.Error()))
+	}
+	return kt
+}
+
+func loadFileKeyTemplate() *KeyTemplate {
+	if keyTemplate.uses("uuid") && keyTemplate.uses("original_name") {
+		return keyTemplate
+	}
+	kt, err := ParseKeyTemplate(keyTemplate.prefix, defaultFileKeyTemplate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return kt
+}
+
+func ParseKeyTemplate(prefix, tmpl string) (*KeyTemplate, error) {
+	kt := &KeyTemplate{prefix: strings.Trim(prefix, "/")}
+	last := 0
+	for _, m := range keyPlaceholder.FindAllStringSubmatchIndex(tmpl, -1) {
+		if m[0] > last {
+			kt.parts = append(kt.parts, keyPart{literal: tmpl[last:m[0]]})
+		}
+		name := tmpl[m[2]:m[3]]
+		if !keyPlaceholders[name] {
+			return nil, fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		part := keyPart{placeholder: name}
+		if m[4] >= 0 {
+			if name != "sha256" {
+				return nil, fmt.Errorf("only {sha256} can be sliced, not {%s}", name)
+			}
+			part.start, _ = strconv.Atoi(tmpl[m[4]:m[5]])
+			part.end, _ = strconv.Atoi(tmpl[m[6]:m[7]])
+			if part.start >= part.end || part.end > 64 {
+				return nil, fmt.Errorf("bad sha256 slice %d:%d", part.start, part.end)
+			}
+		}
+		kt.parts = append(kt.parts, part)
+		last = m[1]
+	}
+	if last < len(tmpl) {
+		kt.parts = append(kt.parts, keyPart{literal: tmpl[last:]})
+	}
+	for _, part := range kt.parts {
+		if strings.ContainsAny(part.literal, "{}") {
+			return nil, fmt.Errorf("malformed placeholder in %q", tmpl)
+		}
+	}
+	if !kt.uses("sha256") {
+		return nil, fmt.Errorf("template %q must contain {sha256} so keys stay unique", tmpl)
+	}
+	// placeholders never render a slash, so a sample shows whether the
+	// literals can make a key storage would refuse
+	sample := kt.Render(KeyFields{
+		Uuid:         "00000000-0000-4000-8000-000000000000",
+		Sha256:       strings.Repeat("0", 64),
+		Ext:          "png",
+		Preset:       presetOriginal,
+		OriginalName: "name.png",
+		Time:         time.Unix(0, 0),
+	})
+	if err := validKey(sample); err != nil {
+		return nil, fmt.Errorf("template %q with prefix %q makes keys such as %q", tmpl, prefix, sample)
+	}
+	return kt, nil
+}
+
+func (kt *KeyTemplate) uses(placeholder string) bool {
+	for _, part := range kt.parts {
+		if part.placeholder == placeholder && part.end == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (kt *KeyTemplate) value(part keyPart, f KeyFields) string {
+	switch part.placeholder {
+	case "uuid":
+		return f.Uuid
+	case "sha256":
+		if part.end > 0 && part.end <= len(f.Sha256) {
+			return f.Sha256[part.start:part.end]
+		}
+		return f.Sha256
+	case "ext":
+		return unsafeKeyChars.ReplaceAllString(f.Ext, "_")
+	// the date the upload started, so a retry after midnight renders
+	// the same key
+	case "yyyy":
+		return f.Time.UTC().Format("2006")
+	case "mm":
+		return f.Time.UTC().Format("01")
+	case "dd":
+		return f.Time.UTC().Format("02")
+	case "preset":
+		return f.Preset
+	case "original_name":
+		name := strings.TrimSuffix(filepath.Base(f.OriginalName), filepath.Ext(f.OriginalName))
+		name = strings.Trim(unsafeKeyChars.ReplaceAllString(name, "_"), "._")
+		if name == "" {
+			name = "file"
+		}
+		return name
+	}
+	return ""
+}
+
+func (kt *KeyTemplate) Render(f KeyFields) string {
+	if f.Time.IsZero() {
+		f.Time = time.Now()
+	}
+	var key []string
+	if kt.prefix != "" {
+		key = append(key, kt.prefix, "/")
+	}
+	for _, part := range kt.parts {
+		if part.placeholder == "" {
+			key = append(key, part.literal)
+			continue
+		}
+		value := kt.value(part, f)
+		if part.placeholder == "ext" && value == "" && len(key) > 0 {
+			// no "name." for files without an extension
+			key[len(key)-1] = strings.TrimSuffix(key[len(key)-1], ".")
+		}
+		key = append(key, value)
+	}
+	return strings.Join(key, "")
+}
+
+// UuidPrefix is the fixed part of every key rendered for uuidv4, when
+// everything up to the {uuid} placeholder is literal. CloudFront cookies
+// need this to cover a whole gallery with one wildcard.
+func (kt *KeyTemplate) UuidPrefix(uuidv4 string) (string, bool) {
+	prefix := ""
+	if kt.prefix != "" {
+		prefix = kt.prefix + "/"
+	}
+	for _, part := range kt.parts {
+		switch part.placeholder {
+		case "":
+			prefix += part.literal
+		case "uuid":
+			return prefix + uuidv4, true
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func objectKey(f KeyFields) string {
+	return keyTemplate.Render(f)
+}
+
+// fileObjectKey is the key of a download, see fileKeyTemplate.
+func fileObjectKey(f KeyFields) string {
+	return fileKeyTemplate.Render(f)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyTemplateRender(t *testing.T) {
+	digest := "ab" + strings.Repeat("0", 62)
+	fields := KeyFields{
+		Uuid:         "u",
+		Sha256:       digest,
+		Ext:          "png",
+		Preset:       presetOriginal,
+		OriginalName: "My Holiday (1).PNG",
+		Time:         time.Date(2026, 1, 2, 23, 30, 0, 0, time.FixedZone("", -3600)),
+	}
+	for _, test := range []struct {
+		prefix, tmpl, want string
+	}{
+		{"", defaultKeyTemplate, "u/" + digest + ".png"},
+		{"/my-app/", defaultKeyTemplate, "my-app/u/" + digest + ".png"},
+		{"", "{sha256:0:2}/{uuid}/{sha256}.{ext}", "ab/u/" + digest + ".png"},
+		{"", "{yyyy}/{mm}/{dd}/{sha256}-{preset}.{ext}", "2026/01/03/" + digest + "-original.png"},
+		{"", "{uuid}/{original_name}-{sha256}.{ext}", "u/My_Holiday_1-" + digest + ".png"},
+	} {
+		kt, err := ParseKeyTemplate(test.prefix, test.tmpl)
+		if err != nil {
+			t.Errorf("%s: %s", test.tmpl, err)
+			continue
+		}
+		if got := kt.Render(fields); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.tmpl, got, test.want)
+		}
+	}
+
+	kt, _ := ParseKeyTemplate("", defaultKeyTemplate)
+	fields.Ext = ""
+	if got := kt.Render(fields); got != "u/"+digest {
+		t.Errorf("no extension: got %s", got)
+	}
+	fields.Ext = `png\..\x`
+	if got := kt.Render(fields); validKey(got) != nil {
+		t.Errorf("extension made key %q", got)
+	}
+}
+
+func TestKeyTemplateRejects(t *testing.T) {
+	for _, test := range []struct{ prefix, tmpl string }{
+		{"", "{uuid}/{name}.{ext}"},
+		{"", "{uuid}.{ext}"},
+		{"", "{uuid}/{sha256:0:8}.{ext}"},
+		{"", "{uuid:0:2}/{sha256}"},
+		{"", "{sha256:4:2}"},
+		{"", "{sha256:0:65}"},
+		{"", "{uuid/{sha256}"},
+		{"", "{uuid}}/{sha256}"},
+		{"", "../{sha256}.{ext}"},
+		{"", "{uuid}/../../{sha256}"},
+		{"", "/{sha256}"},
+		{"", "{uuid}//{sha256}"},
+		{"", `{uuid}\{sha256}`},
+		{"..", "{sha256}"},
+		{"a/./b", "{sha256}"},
+	} {
+		if _, err := ParseKeyTemplate(test.prefix, test.tmpl); err == nil {
+			t.Errorf("accepted %q with prefix %q", test.tmpl, test.prefix)
+		}
+	}
+}
+
+func TestUuidPrefix(t *testing.T) {
+	for _, test := range []struct {
+		prefix, tmpl, want string
+		ok                 bool
+	}{
+		{"", defaultKeyTemplate, "u", true},
+		{"app", "media/{uuid}/{sha256}", "app/media/u", true},
+		{"", "{sha256:0:2}/{uuid}/{sha256}", "", false},
+		{"", defaultSharedKeyTemplate, "", false},
+	} {
+		kt, err := ParseKeyTemplate(test.prefix, test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := kt.UuidPrefix("u"); got != test.want || ok != test.ok {
+			t.Errorf("%s: got %q %v", test.tmpl, got, ok)
+		}
+	}
+}
+
+func TestKeyDateIsUploadStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv(boltChunks, os.Getenv(boltChunks))
+	os.Setenv(boltChunks, filepath.Join(dir, "chunks.db"))
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Form = url.Values{"flowChunkNumber": {"1"}, "flowIdentifier": {"f"}}
+	ff := &FlowFile{name: "u" + "f"}
+	ff.SaveChunkBytes(r, []byte("one"))
+	started := ff.StartedAt()
+	if time.Since(started) > time.Minute {
+		t.Fatalf("started at %s", started)
+	}
+
+	// a later chunk, and another FlowFile for the same upload as a retry
+	// would have, keep the time of the first chunk
+	r.Form.Set("flowChunkNumber", "2")
+	time.Sleep(10 * time.Millisecond)
+	ff.SaveChunkBytes(r, []byte("two"))
+	retry := &FlowFile{name: "uf"}
+	if !retry.StartedAt().Equal(started) {
+		t.Errorf("retry started at %s, first chunk at %s", retry.StartedAt(), started)
+	}
+	if n := retry.NumberOfChunks(); n != 2 {
+		t.Errorf("%d chunks", n)
+	}
+
+	kt, _ := ParseKeyTemplate("", "{yyyy}{mm}{dd}/{sha256}")
+	fields := KeyFields{Sha256: "abc", Time: retry.StartedAt()}
+	if got := kt.Render(fields); got != started.UTC().Format("20060102")+"/abc" {
+		t.Errorf("got %s", got)
+	}
+
+	ff.Delete()
+	if again := (&FlowFile{name: "uf"}).StartedAt(); again.Equal(started) {
+		t.Error("start time outlived the flow file")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"image"
+	"net/http"
+)
+
+var maxImageWidth string = "MAX_IMAGE_WIDTH"
+var maxImageHeight string = "MAX_IMAGE_HEIGHT"
+var maxImageMegapixels string = "MAX_IMAGE_MEGAPIXELS"
+
+type ImageLimits struct {
+	Width      int
+	Height     int
+	Megapixels float64
+}
+
+var imageLimits = ImageLimits{
+	Width:      getEnvInt(maxImageWidth, 10000),
+	Height:     getEnvInt(maxImageHeight, 10000),
+	Megapixels: getEnvFloat(maxImageMegapixels, 50),
+}
+
+// Check rejects an image by its header dimensions, before any pixel data
+// has been decoded. A limit of zero disables that particular check.
+func (l ImageLimits) Check(config image.Config) error {
+	if config.Width <= 0 || config.Height <= 0 {
+		return newUploadError(http.StatusUnprocessableEntity, "invalid_image",
+			"image declares invalid dimensions %dx%d", config.Width, config.Height)
+	}
+	if l.Width > 0 && config.Width > l.Width {
+		return newUploadError(http.StatusRequestEntityTooLarge, "image_too_wide",
+			"image width %d exceeds the limit of %d pixels", config.Width, l.Width)
+	}
+	if l.Height > 0 && config.Height > l.Height {
+		return newUploadError(http.StatusRequestEntityTooLarge, "image_too_tall",
+			"image height %d exceeds the limit of %d pixels", config.Height, l.Height)
+	}
+	megapixels := float64(config.Width) * float64(config.Height) / 1e6
+	if l.Megapixels > 0 && megapixels > l.Megapixels {
+		return newUploadError(http.StatusRequestEntityTooLarge, "image_too_many_pixels",
+			"image has %.1f megapixels, the limit is %.1f", megapixels, l.Megapixels)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+// pngHeader is a PNG with a valid IHDR declaring width x height and no
+// image data, which is all DecodeConfig reads.
+func pngHeader(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	// IHDR data starts after the 8 byte signature, length and type
+	put := func(at, n int) {
+		b[at], b[at+1], b[at+2], b[at+3] = byte(n>>24), byte(n>>16), byte(n>>8), byte(n)
+	}
+	put(16, width)
+	put(20, height)
+	put(29, int(crc32.ChecksumIEEE(b[12:29])))
+	return b
+}
+
+func TestImageLimitsCheck(t *testing.T) {
+	limits := ImageLimits{Width: 100, Height: 50, Megapixels: 0.004}
+	for _, c := range []struct {
+		width, height int
+		code          string
+	}{
+		{60, 50, ""},
+		{0, 10, "invalid_image"},
+		{101, 10, "image_too_wide"},
+		{10, 51, "image_too_tall"},
+		{100, 50, "image_too_many_pixels"},
+	} {
+		err := limits.Check(image.Config{Width: c.width, Height: c.height})
+		if c.code == "" {
+			if err != nil {
+				t.Errorf("%dx%d: %s", c.width, c.height, err)
+			}
+			continue
+		}
+		ue, ok := err.(*uploadError)
+		if !ok || ue.Code != c.code {
+			t.Errorf("%dx%d: got %v, want %s", c.width, c.height, err, c.code)
+		}
+	}
+	if err := (ImageLimits{}).Check(image.Config{Width: 1 << 20, Height: 1 << 20}); err != nil {
+		t.Errorf("zero limits should not reject: %s", err)
+	}
+}
+
+func TestHeaderCheckedBeforeDecoding(t *testing.T) {
+	saved := imageLimits
+	defer func() { imageLimits = saved }()
+	imageLimits = ImageLimits{Width: 1000, Height: 1000}
+
+	huge := pngHeader(t, 100000, 100000)
+	_, err := GetImageConfigFromBytesAndType(".png", huge)
+	if ue, ok := err.(*uploadError); !ok || ue.Status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := ConvertToJpegFromPng(huge); err == nil {
+		t.Error("converted an image over the limits")
+	}
+	if _, err := GetImageConfigFromBytesAndType(".png", []byte("not a png")); err == nil {
+		t.Error("accepted a broken header")
+	}
+	config, err := GetImageConfigFromBytesAndType(".png", pngHeader(t, 1, 1))
+	if err != nil || config.Width != 1 {
+		t.Errorf("got %+v, %v", config, err)
+	}
+}
@@ -0,0 +1,131 @@
+// Package listener subscribes to the upload events go-flow-s3 publishes
+// with Postgres NOTIFY, for services that share its database and want to
+// update caches as soon as a file is stored or deleted.
+//
+//	l, err := listener.New(os.Getenv("IMAGES_POSTGRESQL_DATABASE_STRING"), listener.DefaultChannel)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer l.Close()
+//	for event := range l.Events() {
+//		switch event.Type {
+//		case listener.Stored:
+//			cache.Add(event.Uuid, event.Url)
+//		case listener.Deleted:
+//			cache.Remove(event.Uuid, event.Url)
+//		case listener.Reconnected:
+//			cache.Reload()
+//		}
+//	}
+package listener
+
+import (
+	"encoding/json"
+	"github.com/lib/pq"
+	"time"
+)
+
+// DefaultChannel is the channel go-flow-s3 notifies unless NOTIFY_CHANNEL
+// says otherwise.
+const DefaultChannel = "go_flow_s3"
+
+const (
+	Stored  = "stored"
+	Deleted = "deleted"
+
+	// Reconnected is sent after the connection to Postgres was lost.
+	// Notifications sent in the meantime are gone, so anything derived
+	// from them should be reloaded.
+	Reconnected = "reconnected"
+)
+
+// Event is the payload of a notification.
+type Event struct {
+	Type   string `json:"event"`
+	Uuid   string `json:"uuid"`
+	Url    string `json:"url"`
+	Height int    `json:"height"`
+	Width  int    `json:"width"`
+}
+
+// Payload is the NOTIFY payload for e.
+func (e Event) Payload() (string, error) {
+	b, err := json.Marshal(e)
+	return string(b), err
+}
+
+// Listener delivers the events of one channel. It reconnects on its own
+// and pings the server to notice dead connections.
+type Listener struct {
+	pq     *pq.Listener
+	notify <-chan *pq.Notification
+	events chan Event
+	done   chan struct{}
+}
+
+// pingInterval is how often an idle connection is checked.
+const pingInterval = 90 * time.Second
+
+// New connects to the database at connString and listens on channel.
+func New(connString, channel string) (*Listener, error) {
+	l := &Listener{
+		pq:     pq.NewListener(connString, 10*time.Second, time.Minute, nil),
+		events: make(chan Event, 32),
+		done:   make(chan struct{}),
+	}
+	if err := l.pq.Listen(channel); err != nil {
+		l.pq.Close()
+		return nil, err
+	}
+	l.notify = l.pq.Notify
+	go l.run()
+	return l, nil
+}
+
+// Events is closed when the Listener is.
+func (l *Listener) Events() <-chan Event {
+	return l.events
+}
+
+func (l *Listener) run() {
+	defer close(l.events)
+	for {
+		select {
+		case n, ok := <-l.notify:
+			if !ok {
+				return
+			}
+			// pq sends nil after reconnecting
+			if n == nil {
+				l.send(Event{Type: Reconnected})
+				continue
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(n.Extra), &event); err != nil {
+				continue
+			}
+			l.send(event)
+		case <-time.After(pingInterval):
+			if l.pq != nil {
+				go l.pq.Ping()
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *Listener) send(event Event) {
+	select {
+	case l.events <- event:
+	case <-l.done:
+	}
+}
+
+func (l *Listener) Close() error {
+	close(l.done)
+	if l.pq == nil {
+		return nil
+	}
+	return l.pq.Close()
+}
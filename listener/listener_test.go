@@ -0,0 +1,87 @@
+package listener
+
+import (
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+// fakeListener runs a Listener on notify instead of a connection.
+func fakeListener(notify chan *pq.Notification) *Listener {
+	l := &Listener{notify: notify, events: make(chan Event, 32), done: make(chan struct{})}
+	go l.run()
+	return l
+}
+
+func next(t *testing.T, l *Listener) Event {
+	select {
+	case event, ok := <-l.Events():
+		if !ok {
+			t.Fatal("events closed")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestNotify(t *testing.T) {
+	notify := make(chan *pq.Notification)
+	l := fakeListener(notify)
+	defer l.Close()
+
+	stored := Event{Type: Stored, Uuid: "u1", Url: "u1/a.png", Height: 100, Width: 200}
+	payload, err := stored.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify <- &pq.Notification{Channel: DefaultChannel, Extra: "not json"}
+	notify <- &pq.Notification{Channel: DefaultChannel, Extra: payload}
+	if event := next(t, l); event != stored {
+		t.Errorf("got %+v, want %+v", event, stored)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	notify := make(chan *pq.Notification)
+	l := fakeListener(notify)
+	defer l.Close()
+
+	notify <- nil
+	if event := next(t, l); event.Type != Reconnected {
+		t.Errorf("got %+v after reconnecting", event)
+	}
+	deleted, _ := Event{Type: Deleted, Uuid: "u1", Url: "u1/a.png"}.Payload()
+	notify <- &pq.Notification{Extra: deleted}
+	if event := next(t, l); event.Type != Deleted {
+		t.Errorf("got %+v after the reconnect", event)
+	}
+}
+
+func TestClose(t *testing.T) {
+	l := fakeListener(make(chan *pq.Notification))
+	l.Close()
+	select {
+	case _, ok := <-l.Events():
+		if ok {
+			t.Error("event after close")
+		}
+	case <-time.After(time.Second):
+		t.Error("events not closed")
+	}
+
+	// a closed connection ends the events too
+	notify := make(chan *pq.Notification)
+	l = fakeListener(notify)
+	defer l.Close()
+	close(notify)
+	select {
+	case _, ok := <-l.Events():
+		if ok {
+			t.Error("event after the connection closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("events not closed")
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var migrateOnStart string = "MIGRATE_ON_START"
+
+// Migration is one step of the schema. Versions are applied in order and
+// never edited once released: change the schema with a new migration.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// migrations create the schema from scratch and bring databases set up
+// from the old vault.sql, or by hand, to the same state, which is why they
+// check before they create.
+var migrations = []Migration{
+	{1, "images", `
+create table if not exists images (
+  uuid uuid,
+  url text,
+  height int,
+  width int,
+  primary key(uuid, url)
+);
+`},
+	// probed pdf and video attributes, see storedMetadata in flowFile.go
+	{2, "images metadata", `
+alter table images add column if not exists metadata jsonb;
+`},
+	// vault.sql used to create a table named vault, while the server has
+	// always used images. Rows are copied over and vault is kept under a
+	// new name, to be dropped once checked. An images table made by hand
+	// may lack the primary key, so rows already there are skipped without
+	// relying on it.
+	{3, "vault into images", `
+do $$
+begin
+  if to_regclass('vault') is null then
+    return;
+  end if;
+  if exists (select 1 from information_schema.columns
+      where table_schema = current_schema() and table_name = 'vault' and column_name = 'metadata') then
+    insert into images (uuid, url, height, width, metadata)
+      select distinct on (uuid, url) uuid, url, height, width, metadata from vault v
+      where not exists (select 1 from images i where i.uuid = v.uuid and i.url = v.url);
+  else
+    insert into images (uuid, url, height, width)
+      select distinct on (uuid, url) uuid, url, height, width from vault v
+      where not exists (select 1 from images i where i.uuid = v.uuid and i.url = v.url);
+  end if;
+  alter table vault rename to vault_migrated;
+end $$;
+`},
+	// background work shared by every instance, see queue.go
+	{4, "queue jobs", `
+create table if not exists queue_jobs (
+  id bigserial primary key,
+  queue text not null,
+  payload jsonb not null default '{}',
+  state text not null default 'queued',
+  attempts int not null default 0,
+  max_attempts int not null default 10,
+  run_at timestamptz not null default now(),
+  locked_by text,
+  locked_until timestamptz,
+  last_error text,
+  created_at timestamptz not null default now(),
+  updated_at timestamptz not null default now()
+);
+
+create index if not exists queue_jobs_ready on queue_jobs (queue, run_at, id) where state in ('queued', 'running');
+`},
+	// one row per attempt at delivering a webhook, see webhooks.go
+	{5, "webhook deliveries", `
+create table if not exists webhook_deliveries (
+  id bigserial primary key,
+  job_id bigint not null,
+  event_id uuid not null,
+  event_type text not null,
+  uuid uuid not null,
+  endpoint text not null,
+  attempt int not null,
+  status_code int not null,
+  response_body text not null,
+  error text not null,
+  duration_ms bigint not null,
+  created_at timestamptz not null default now()
+);
+
+create index if not exists webhook_deliveries_uuid on webhook_deliveries (uuid, created_at);
+`},
+	// rows from before it get an id derived from uuid and url, and
+	// created_at is when it ran. Videos are told apart by the extension
+	// the server gave their url, see video.go.
+	{6, "file records", `
+alter table images
+  add column if not exists id uuid,
+  add column if not exists kind text not null default 'file',
+  add column if not exists original_name text not null default '',
+  add column if not exists size bigint not null default 0,
+  add column if not exists mime_type text not null default '',
+  add column if not exists sha256 text not null default '',
+  add column if not exists conversion text not null default '',
+  add column if not exists created_at timestamptz not null default now();
+
+update images set
+  id = md5(uuid::text || '/' || url)::uuid,
+  kind = case
+    when width > 0 then 'image'
+    when lower(url) ~ '` + videoURLPattern() + `' then 'video'
+    else 'file'
+  end
+where id is null;
+
+alter table images alter column id set not null;
+create unique index if not exists images_id on images (id);
+`},
+	// keyset pagination of listings for each sort, see fileRecords.go
+	{7, "file listing indexes", `
+create index if not exists images_uuid_created_at on images (uuid, created_at, id);
+create index if not exists images_uuid_size on images (uuid, size, id);
+create index if not exists images_uuid_width on images (uuid, width, id);
+create index if not exists images_uuid_height on images (uuid, height, id);
+`},
+}
+
+// videoURLPattern matches the urls of videos, by the extensions in
+// videoMimeTypes.
+func videoURLPattern() string {
+	extensions := make([]string, 0, len(videoMimeTypes))
+	for ext := range videoMimeTypes {
+		extensions = append(extensions, regexp.QuoteMeta(strings.TrimPrefix(ext, ".")))
+	}
+	sort.Strings(extensions)
+	return `\.(` + strings.Join(extensions, "|") + `)$`
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// schemaVersion is the last migration applied to db, 0 for a database that
+// was never migrated.
+func schemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, "select to_regclass('schema_migrations') is not null").Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRowContext(ctx, "select coalesce(max(version), 0) from schema_migrations").Scan(&version)
+	return version, err
+}
+
+// migrateUp applies the pending migrations, each in its own transaction
+// with its schema_migrations row. The table lock makes instances started
+// together take turns, and the check after it skips what another did.
+func migrateUp(db *sql.DB) ([]Migration, error) {
+	_, err := db.Exec(`create table if not exists schema_migrations (
+		version int primary key,
+		name text not null,
+		applied_at timestamptz not null default now())`)
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, migration := range migrations {
+		ok, err := applyMigration(db, migration)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %s", migration.Version, migration.Name, err)
+		}
+		if ok {
+			applied = append(applied, migration)
+		}
+	}
+	return applied, nil
+}
+
+func applyMigration(db *sql.DB, migration Migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("set local statement_timeout = 0"); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("lock table schema_migrations in exclusive mode"); err != nil {
+		return false, err
+	}
+	var done bool
+	err = tx.QueryRow("select exists(select 1 from schema_migrations where version = $1)",
+		migration.Version).Scan(&done)
+	if err != nil || done {
+		return false, err
+	}
+	if _, err := tx.Exec(migration.SQL); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("insert into schema_migrations (version, name) values ($1, $2)",
+		migration.Version, migration.Name)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// checkSchema stops the server when its database is behind, unless
+// MIGRATE_ON_START lets it migrate. A database it cannot reach is left to
+// the requests, which fail and retry as they would later on.
+func checkSchema() {
+	if os.Getenv("IMAGES_POSTGRESQL_DATABASE_STRING") == "" {
+		return
+	}
+	db := getDB()
+	ctx, cancel := dbContext()
+	defer cancel()
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		fmt.Println("Could not check schema version", err)
+		return
+	}
+	latest := latestSchemaVersion()
+	switch {
+	case version > latest:
+		fmt.Println("Database schema is at version", version, "but this server only knows up to", latest)
+	case version < latest && getEnvBool(migrateOnStart, false):
+		applied, err := migrateUp(db)
+		for _, migration := range applied {
+			fmt.Println("Applied migration", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case version < latest:
+		log.Fatal(fmt.Sprintf("Database schema is at version %d, this server needs %d. Run go-flow-s3 migrate up.",
+			version, latest))
+	}
+}
+
+// migrateCommand runs "migrate up" and "migrate status".
+func migrateCommand(args []string) {
+	db := getDB()
+	if len(args) == 1 && args[0] == "up" {
+		applied, err := migrateUp(db)
+		for _, migration := range applied {
+			fmt.Println("Applied", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date at version", latestSchemaVersion())
+		}
+		return
+	}
+	if len(args) == 0 || args[0] == "status" {
+		appliedAt := map[int]time.Time{}
+		version, err := schemaVersion(context.Background(), db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if version > 0 {
+			rows, err := db.Query("select version, applied_at from schema_migrations")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var v int
+				var at time.Time
+				if err := rows.Scan(&v, &at); err != nil {
+					log.Fatal(err)
+				}
+				appliedAt[v] = at
+			}
+			if err := rows.Err(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, migration := range migrations {
+			state := "pending"
+			if at, ok := appliedAt[migration.Version]; ok {
+				state = at.UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%4d %-20s %s\n", migration.Version, migration.Name, state)
+		}
+		return
+	}
+	fmt.Println("Usage: go-flow-s3 migrate [status | up]")
+	os.Exit(1)
+}
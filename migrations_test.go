@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDatabase is a Postgres connection string for tests that need a real
+// database. They are skipped without it.
+var testDatabase string = "TEST_POSTGRESQL_DATABASE_STRING"
+
+func TestMigrationsInOrder(t *testing.T) {
+	names := map[string]bool{}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %q is version %d, want %d", migration.Name, migration.Version, i+1)
+		}
+		if names[migration.Name] {
+			t.Errorf("migration name %q is used twice", migration.Name)
+		}
+		names[migration.Name] = true
+	}
+	if latestSchemaVersion() != len(migrations) {
+		t.Errorf("latest version %d of %d migrations", latestSchemaVersion(), len(migrations))
+	}
+}
+
+// withSearchPath points connString at schema, for either form lib/pq
+// accepts.
+func withSearchPath(connString, schema string) string {
+	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+		u, err := url.Parse(connString)
+		if err != nil {
+			return connString
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return connString + " search_path=" + schema
+}
+
+// openTestSchema opens TEST_POSTGRESQL_DATABASE_STRING in a schema of its
+// own, dropped by the returned func.
+func openTestSchema(t *testing.T) (*sql.DB, func()) {
+	connString := os.Getenv(testDatabase)
+	if connString == "" {
+		t.Skip("set " + testDatabase + " to run against Postgres")
+	}
+	admin, err := sql.Open("postgres", connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("go_flow_s3_test_%d_%d", time.Now().Unix(), rand.Intn(1e6))
+	if _, err := admin.Exec("create schema " + schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", withSearchPath(connString, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		admin.Exec("drop schema " + schema + " cascade")
+		admin.Close()
+	}
+}
+
+func TestMigrateUp(t *testing.T) {
+	db, drop := openTestSchema(t)
+	defer drop()
+
+	// a database set up with the old vault.sql, by hand and without the
+	// images primary key
+	for _, statement := range []string{
+		`create table vault (uuid uuid, url text, height int, width int, metadata jsonb)`,
+		`insert into vault values
+			('5f4dcc3b-5aa7-4d61-9d32-1b5b5c6d7e8f', 'a.png', 10, 20, '{"svg": {}}'),
+			('5f4dcc3b-5aa7-4d61-9d32-1b5b5c6d7e8f', 'a.png', 10, 20, '{"svg": {}}'),
+			('5f4dcc3b-5aa7-4d61-9d32-1b5b5c6d7e8f', 'b.pdf', 0, 0, null),
+			('5f4dcc3b-5aa7-4d61-9d32-1b5b5c6d7e8f', 'c.MP4', 0, 0, null)`,
+		`create table images (uuid uuid, url text, height int, width int)`,
+		`insert into images values ('5f4dcc3b-5aa7-4d61-9d32-1b5b5c6d7e8f', 'b.pdf', 0, 0)`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if version, err := schemaVersion(context.Background(), db); err != nil || version != 0 {
+		t.Fatalf("fresh schema at %d, %v", version, err)
+	}
+	applied, err := migrateUp(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("applied %d of %d migrations", len(applied), len(migrations))
+	}
+	if version, err := schemaVersion(context.Background(), db); err != nil || version != latestSchemaVersion() {
+		t.Errorf("migrated to %d, %v", version, err)
+	}
+
+	var rows int
+	if err := db.QueryRow(`select count(*) from images`).Scan(&rows); err != nil || rows != 3 {
+		t.Errorf("images has %d rows, %v", rows, err)
+	}
+	var metadata string
+	err = db.QueryRow(`select metadata::text from images where url = 'a.png'`).Scan(&metadata)
+	if err != nil || !strings.Contains(metadata, "svg") {
+		t.Errorf("metadata %q, %v", metadata, err)
+	}
+	kinds := map[string]string{}
+	kindRows, err := db.Query(`select url, kind from images where id is not null`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kindRows.Next() {
+		var url, kind string
+		if err := kindRows.Scan(&url, &kind); err != nil {
+			t.Fatal(err)
+		}
+		kinds[url] = kind
+	}
+	kindRows.Close()
+	if kinds["a.png"] != "image" || kinds["b.pdf"] != "file" || kinds["c.MP4"] != "video" {
+		t.Errorf("kinds %v", kinds)
+	}
+	var renamed bool
+	if err := db.QueryRow(`select to_regclass('vault_migrated') is not null`).Scan(&renamed); err != nil || !renamed {
+		t.Errorf("vault not kept as vault_migrated, %v", err)
+	}
+
+	again, err := migrateUp(db)
+	if err != nil || len(again) != 0 {
+		t.Errorf("second run applied %d, %v", len(again), err)
+	}
+}
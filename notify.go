@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/wlaurance/go-flow-s3/listener"
+	"os"
+)
+
+var notifyChannel string = "NOTIFY_CHANNEL"
+
+// eventChannel is where stores and deletions are announced, see the
+// listener package for subscribing.
+var eventChannel = loadEventChannel()
+
+func loadEventChannel() string {
+	if channel := os.Getenv(notifyChannel); channel != "" {
+		return channel
+	}
+	return listener.DefaultChannel
+}
+
+// notifyEvent sends event within tx, so listeners only hear about it once
+// the change it describes is committed.
+func notifyEvent(ctx context.Context, tx *sql.Tx, event listener.Event) error {
+	payload, err := event.Payload()
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "select pg_notify($1, $2)", eventChannel, payload)
+	return err
+}
+
+// deleteAttributes removes the row of imageData and announces it. This
+// server never deletes uploads itself, it is for code built on it that
+// does.
+func deleteAttributes(imageData ImageData) error {
+	ctx, cancel := dbContext()
+	defer cancel()
+	tx, err := getDB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "delete from images where uuid = $1 and url = $2", imageData.Uuid, imageData.Url)
+	if err == nil {
+		err = notifyEvent(ctx, tx, listener.Event{
+			Type:   listener.Deleted,
+			Uuid:   imageData.Uuid,
+			Url:    imageData.Url,
+			Height: imageData.Height,
+			Width:  imageData.Width,
+		})
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// PdfInfo is what we can learn about a PDF without rendering it. MediaBox
+// is [llx lly urx ury] of the first page in PDF points (1/72 inch).
+type PdfInfo struct {
+	Version   string     `json:"version"`
+	Pages     int        `json:"pages"`
+	MediaBox  [4]float64 `json:"media_box"`
+	Width     float64    `json:"width"`
+	Height    float64    `json:"height"`
+	Encrypted bool       `json:"encrypted"`
+}
+
+var errPdfSyntax = errors.New("pdf syntax error")
+
+var pdfHeader = regexp.MustCompile(`%PDF-(\d\.\d)`)
+var pdfObjHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// maximum depth for the page tree and nested values, so a hostile file
+// cannot make us recurse forever
+const pdfMaxDepth = 64
+
+// pdfMaxStreamSize caps what a single stream may inflate to. Only xref and
+// object streams are decoded, which are far smaller in real documents, so
+// anything larger is a compression bomb.
+var pdfMaxStreamSize = 32 << 20
+
+// pdfMaxFieldWidth is the widest xref stream field that fits an int64.
+const pdfMaxFieldWidth = 8
+
+type pdfName string
+type pdfDict map[pdfName]interface{}
+type pdfArray []interface{}
+
+type pdfRef struct {
+	num, gen int
+}
+
+type pdfStream struct {
+	dict pdfDict
+	data []byte
+}
+
+type pdfCompressedRef struct {
+	stream, index int
+}
+
+type pdfDoc struct {
+	err        *uploadError
+	data       []byte
+	offsets    map[int]int
+	compressed map[int]pdfCompressedRef
+	trailer    pdfDict
+	cache      map[int]interface{}
+	objStms    map[int][]interface{}
+}
+
+// ProbePdf reads the cross-reference table and page tree of a PDF. It
+// reports whatever it could find; for encrypted files with compressed
+// object streams that may be only the version.
+func ProbePdf(b []byte) (info PdfInfo, err error) {
+	// the parser checks what it reads, this keeps a case it missed from
+	// failing the upload
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("pdf parser: %v", r)
+		}
+	}()
+	head := b
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	m := pdfHeader.FindSubmatch(head)
+	if m == nil {
+		return info, errors.New("missing %PDF header")
+	}
+	info.Version = string(m[1])
+
+	doc := newPdfDoc(b)
+	if err := doc.readXref(); err != nil {
+		if ue, ok := err.(*uploadError); ok {
+			return info, ue
+		}
+		doc.scanObjects()
+	}
+	if doc.err != nil {
+		return info, doc.err
+	}
+	_, info.Encrypted = doc.trailer["Encrypt"]
+
+	root, ok := doc.resolve(doc.trailer["Root"]).(pdfDict)
+	if !ok {
+		if info.Encrypted {
+			return info, nil
+		}
+		return info, errors.New("pdf has no document catalog")
+	}
+	if v, ok := doc.resolve(root["Version"]).(pdfName); ok && string(v) > info.Version {
+		info.Version = string(v)
+	}
+	pages, ok := doc.resolve(root["Pages"]).(pdfDict)
+	if !ok {
+		return info, errors.New("pdf has no page tree")
+	}
+	if count, ok := doc.resolve(pages["Count"]).(float64); ok {
+		info.Pages = int(count)
+	}
+
+	node := pages
+	var mediaBox pdfArray
+	for depth := 0; depth < pdfMaxDepth; depth++ {
+		if mb, ok := doc.resolve(node["MediaBox"]).(pdfArray); ok {
+			mediaBox = mb
+		}
+		kids, ok := doc.resolve(node["Kids"]).(pdfArray)
+		if !ok || len(kids) == 0 {
+			break
+		}
+		next, ok := doc.resolve(kids[0]).(pdfDict)
+		if !ok {
+			break
+		}
+		node = next
+	}
+	if doc.err != nil {
+		return info, doc.err
+	}
+	if len(mediaBox) == 4 {
+		for i := range mediaBox {
+			n, _ := doc.resolve(mediaBox[i]).(float64)
+			info.MediaBox[i] = n
+		}
+		info.Width = info.MediaBox[2] - info.MediaBox[0]
+		info.Height = info.MediaBox[3] - info.MediaBox[1]
+		if info.Width < 0 {
+			info.Width = -info.Width
+		}
+		if info.Height < 0 {
+			info.Height = -info.Height
+		}
+	}
+	return info, nil
+}
+
+func newPdfDoc(b []byte) *pdfDoc {
+	return &pdfDoc{
+		data:       b,
+		offsets:    make(map[int]int),
+		compressed: make(map[int]pdfCompressedRef),
+		trailer:    make(pdfDict),
+		cache:      make(map[int]interface{}),
+		objStms:    make(map[int][]interface{}),
+	}
+}
+
+// readXref follows startxref and every /Prev section behind it. Entries
+// from newer sections win, as do their trailer keys.
+func (doc *pdfDoc) readXref() error {
+	i := bytes.LastIndex(doc.data, []byte("startxref"))
+	if i < 0 {
+		return errPdfSyntax
+	}
+	p := &pdfParser{data: doc.data, pos: i + len("startxref")}
+	offset, ok := p.parseValue(0).(float64)
+	if !ok {
+		return errPdfSyntax
+	}
+	seen := make(map[int]bool)
+	for next := int(offset); next > 0 && !seen[next]; {
+		seen[next] = true
+		trailer, err := doc.readXrefSection(next)
+		if err != nil {
+			return err
+		}
+		for k, v := range trailer {
+			if _, ok := doc.trailer[k]; !ok {
+				doc.trailer[k] = v
+			}
+		}
+		if stm, ok := trailer["XRefStm"].(float64); ok && !seen[int(stm)] {
+			seen[int(stm)] = true
+			if _, err := doc.readXrefSection(int(stm)); err != nil {
+				return err
+			}
+		}
+		prev, _ := trailer["Prev"].(float64)
+		next = int(prev)
+	}
+	if len(doc.offsets) == 0 && len(doc.compressed) == 0 {
+		return errPdfSyntax
+	}
+	return nil
+}
+
+func (doc *pdfDoc) readXrefSection(offset int) (pdfDict, error) {
+	if offset < 0 || offset >= len(doc.data) {
+		return nil, errPdfSyntax
+	}
+	p := &pdfParser{data: doc.data, pos: offset}
+	p.skipSpace()
+	if !p.consumeKeyword("xref") {
+		return doc.readXrefStream(offset)
+	}
+	for {
+		p.skipSpace()
+		if p.consumeKeyword("trailer") {
+			trailer, ok := p.parseValue(0).(pdfDict)
+			if !ok {
+				return nil, errPdfSyntax
+			}
+			return trailer, nil
+		}
+		start, ok1 := p.parseValue(0).(float64)
+		count, ok2 := p.parseValue(0).(float64)
+		if !ok1 || !ok2 {
+			return nil, errPdfSyntax
+		}
+		for n := int(start); n < int(start)+int(count); n++ {
+			p.skipSpace()
+			if p.pos+18 > len(p.data) {
+				return nil, errPdfSyntax
+			}
+			entry := p.data[p.pos : p.pos+18]
+			p.pos += 18
+			off, err := strconv.Atoi(string(entry[0:10]))
+			if err != nil {
+				return nil, errPdfSyntax
+			}
+			if entry[17] != 'n' {
+				continue
+			}
+			if _, ok := doc.offsets[n]; !ok {
+				if _, ok := doc.compressed[n]; !ok {
+					doc.offsets[n] = off
+				}
+			}
+		}
+	}
+}
+
+// readXrefStream handles the PDF 1.5 form where the cross-reference table
+// is itself a compressed stream object.
+func (doc *pdfDoc) readXrefStream(offset int) (pdfDict, error) {
+	stream, ok := doc.parseObjectAt(offset).(pdfStream)
+	if !ok || stream.dict["Type"] != pdfName("XRef") {
+		return nil, errPdfSyntax
+	}
+	data, err := decodePdfStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	w, ok := stream.dict["W"].(pdfArray)
+	if !ok || len(w) != 3 {
+		return nil, errPdfSyntax
+	}
+	var widths [3]int
+	rowLen := 0
+	for i := range w {
+		n, ok := pdfInt(w[i])
+		if !ok || n < 0 || n > pdfMaxFieldWidth {
+			return nil, errPdfSyntax
+		}
+		widths[i] = n
+		rowLen += n
+	}
+	if rowLen == 0 {
+		return nil, errPdfSyntax
+	}
+	index, ok := stream.dict["Index"].(pdfArray)
+	if !ok {
+		index = pdfArray{float64(0), stream.dict["Size"]}
+	}
+	row := 0
+	for i := 0; i+1 < len(index); i += 2 {
+		start, ok1 := pdfInt(index[i])
+		count, ok2 := pdfInt(index[i+1])
+		if !ok1 || !ok2 || start < 0 || count < 0 {
+			return nil, errPdfSyntax
+		}
+		for n := start; n < start+count; n++ {
+			if (row+1)*rowLen > len(data) {
+				return stream.dict, nil
+			}
+			fields := data[row*rowLen : (row+1)*rowLen]
+			row++
+			var values [3]int
+			pos := 0
+			for f := 0; f < 3; f++ {
+				for k := 0; k < widths[f]; k++ {
+					values[f] = values[f]<<8 | int(fields[pos])
+					pos++
+				}
+			}
+			if widths[0] == 0 {
+				values[0] = 1
+			}
+			if values[1] < 0 || values[2] < 0 {
+				continue
+			}
+			if _, ok := doc.offsets[n]; ok {
+				continue
+			}
+			if _, ok := doc.compressed[n]; ok {
+				continue
+			}
+			switch values[0] {
+			case 1:
+				doc.offsets[n] = values[1]
+			case 2:
+				doc.compressed[n] = pdfCompressedRef{stream: values[1], index: values[2]}
+			}
+		}
+	}
+	return stream.dict, nil
+}
+
+// scanObjects rebuilds the object table by searching for "N G obj" when
+// the cross-reference data is missing or damaged, as most viewers do.
+func (doc *pdfDoc) scanObjects() {
+	doc.offsets = make(map[int]int)
+	doc.compressed = make(map[int]pdfCompressedRef)
+	for _, m := range pdfObjHeader.FindAllSubmatchIndex(doc.data, -1) {
+		num, err := strconv.Atoi(string(doc.data[m[2]:m[3]]))
+		if err != nil {
+			continue
+		}
+		doc.offsets[num] = m[0]
+	}
+	for i := bytes.Index(doc.data, []byte("trailer")); i >= 0; {
+		p := &pdfParser{data: doc.data, pos: i + len("trailer")}
+		if trailer, ok := p.parseValue(0).(pdfDict); ok {
+			for k, v := range trailer {
+				doc.trailer[k] = v
+			}
+		}
+		j := bytes.Index(doc.data[i+1:], []byte("trailer"))
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	if _, ok := doc.trailer["Root"]; ok {
+		return
+	}
+	for num := range doc.offsets {
+		obj, ok := doc.getObject(num).(pdfDict)
+		if ok && obj["Type"] == pdfName("Catalog") {
+			doc.trailer["Root"] = pdfRef{num: num}
+			return
+		}
+	}
+}
+
+func (doc *pdfDoc) resolve(v interface{}) interface{} {
+	for depth := 0; depth < pdfMaxDepth; depth++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			if stream, ok := v.(pdfStream); ok {
+				return stream.dict
+			}
+			return v
+		}
+		v = doc.getObject(ref.num)
+	}
+	return nil
+}
+
+func (doc *pdfDoc) getObject(num int) interface{} {
+	if obj, ok := doc.cache[num]; ok {
+		return obj
+	}
+	// guard against reference cycles while this object is being loaded
+	doc.cache[num] = nil
+	var obj interface{}
+	if offset, ok := doc.offsets[num]; ok {
+		obj = doc.parseObjectAt(offset)
+	} else if ref, ok := doc.compressed[num]; ok {
+		objs := doc.loadObjStm(ref.stream)
+		if ref.index >= 0 && ref.index < len(objs) {
+			obj = objs[ref.index]
+		}
+	}
+	doc.cache[num] = obj
+	return obj
+}
+
+func (doc *pdfDoc) loadObjStm(num int) []interface{} {
+	if objs, ok := doc.objStms[num]; ok {
+		return objs
+	}
+	doc.objStms[num] = nil
+	offset, ok := doc.offsets[num]
+	if !ok {
+		return nil
+	}
+	stream, ok := doc.parseObjectAt(offset).(pdfStream)
+	if !ok {
+		return nil
+	}
+	data, err := decodePdfStream(stream)
+	if ue, ok := err.(*uploadError); ok && doc.err == nil {
+		doc.err = ue
+	}
+	if err != nil {
+		return nil
+	}
+	n, ok1 := pdfInt(stream.dict["N"])
+	first, ok2 := pdfInt(stream.dict["First"])
+	// every object takes at least its number and offset in the header
+	if !ok1 || !ok2 || n < 0 || n > len(data)/2 || first < 0 || first > len(data) {
+		return nil
+	}
+	p := &pdfParser{data: data}
+	objOffsets := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		p.parseValue(0)
+		off, ok := pdfInt(p.parseValue(0))
+		if !ok {
+			break
+		}
+		objOffsets = append(objOffsets, first+off)
+	}
+	objs := make([]interface{}, len(objOffsets))
+	for i, off := range objOffsets {
+		if off >= first && off < len(data) {
+			objs[i] = (&pdfParser{data: data, pos: off}).parseValue(0)
+		}
+	}
+	doc.objStms[num] = objs
+	return objs
+}
+
+func (doc *pdfDoc) parseObjectAt(offset int) interface{} {
+	if offset < 0 || offset >= len(doc.data) {
+		return nil
+	}
+	p := &pdfParser{data: doc.data, pos: offset}
+	if _, ok := p.parseValue(0).(float64); !ok {
+		return nil
+	}
+	if _, ok := p.parseValue(0).(float64); !ok {
+		return nil
+	}
+	p.skipSpace()
+	if !p.consumeKeyword("obj") {
+		return nil
+	}
+	obj := p.parseValue(0)
+	dict, ok := obj.(pdfDict)
+	if !ok {
+		return obj
+	}
+	p.skipSpace()
+	if !p.consumeKeyword("stream") {
+		return obj
+	}
+	if p.pos < len(p.data) && p.data[p.pos] == '\r' {
+		p.pos++
+	}
+	if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+		p.pos++
+	}
+	start := p.pos
+	end := -1
+	if length, ok := dict["Length"].(float64); ok && start+int(length) <= len(p.data) {
+		end = start + int(length)
+	} else if ref, ok := dict["Length"].(pdfRef); ok {
+		if length, ok := doc.getObject(ref.num).(float64); ok && start+int(length) <= len(p.data) {
+			end = start + int(length)
+		}
+	}
+	if end < 0 {
+		i := bytes.Index(p.data[start:], []byte("endstream"))
+		if i < 0 {
+			return nil
+		}
+		end = start + i
+	}
+	return pdfStream{dict: dict, data: p.data[start:end]}
+}
+
+func decodePdfStream(stream pdfStream) ([]byte, error) {
+	filter := stream.dict["Filter"]
+	params, _ := stream.dict["DecodeParms"].(pdfDict)
+	if filters, ok := filter.(pdfArray); ok {
+		if len(filters) > 1 {
+			return nil, errors.New("unsupported pdf filter chain")
+		}
+		if len(filters) == 1 {
+			filter = filters[0]
+		} else {
+			filter = nil
+		}
+		if ps, ok := stream.dict["DecodeParms"].(pdfArray); ok && len(ps) == 1 {
+			params, _ = ps[0].(pdfDict)
+		}
+	}
+	if filter == nil {
+		return stream.data, nil
+	}
+	if filter != pdfName("FlateDecode") {
+		return nil, fmt.Errorf("unsupported pdf filter %v", filter)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(stream.data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(zr, int64(pdfMaxStreamSize)+1))
+	if len(data) > pdfMaxStreamSize {
+		return nil, newUploadError(http.StatusRequestEntityTooLarge, "pdf_stream_too_large",
+			"a pdf stream inflates to more than %d bytes", pdfMaxStreamSize)
+	}
+	if err != nil && len(data) == 0 {
+		return nil, err
+	}
+	predictor, _ := params["Predictor"].(float64)
+	if predictor < 10 {
+		return data, nil
+	}
+	columns, ok := params["Columns"].(float64)
+	if !ok {
+		columns = 1
+	}
+	return pngUnpredict(data, int(columns))
+}
+
+// pdfInt is v as an int, if it is a whole number of a sane size.
+func pdfInt(v interface{}) (int, bool) {
+	f, ok := v.(float64)
+	if !ok || f != math.Trunc(f) || math.Abs(f) > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// pngUnpredict reverses the PNG row filters used by xref and object
+// streams, assuming one byte per pixel as those streams always do.
+func pngUnpredict(data []byte, columns int) ([]byte, error) {
+	rowLen := columns + 1
+	if columns <= 0 || len(data)%rowLen != 0 {
+		return nil, errPdfSyntax
+	}
+	out := make([]byte, 0, len(data)/rowLen*columns)
+	prev := make([]byte, columns)
+	for r := 0; r < len(data)/rowLen; r++ {
+		row := data[r*rowLen : (r+1)*rowLen]
+		cur := make([]byte, columns)
+		for i := 0; i < columns; i++ {
+			var left, up, upLeft byte
+			if i > 0 {
+				left = cur[i-1]
+				upLeft = prev[i-1]
+			}
+			up = prev[i]
+			switch row[0] {
+			case 0:
+				cur[i] = row[i+1]
+			case 1:
+				cur[i] = row[i+1] + left
+			case 2:
+				cur[i] = row[i+1] + up
+			case 3:
+				cur[i] = row[i+1] + byte((int(left)+int(up))/2)
+			case 4:
+				cur[i] = row[i+1] + paeth(left, up, upLeft)
+			default:
+				return nil, errPdfSyntax
+			}
+		}
+		out = append(out, cur...)
+		prev = cur
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := absInt(p-int(a)), absInt(p-int(b)), absInt(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+type pdfParser struct {
+	data []byte
+	pos  int
+}
+
+func isPdfSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPdfDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+func (p *pdfParser) skipSpace() {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if isPdfSpace(c) {
+			p.pos++
+		} else if c == '%' {
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '\r' {
+				p.pos++
+			}
+		} else {
+			return
+		}
+	}
+}
+
+func (p *pdfParser) consumeKeyword(kw string) bool {
+	if !bytes.HasPrefix(p.data[p.pos:], []byte(kw)) {
+		return false
+	}
+	end := p.pos + len(kw)
+	if end < len(p.data) && !isPdfSpace(p.data[end]) && !isPdfDelimiter(p.data[end]) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *pdfParser) readToken() string {
+	start := p.pos
+	for p.pos < len(p.data) && !isPdfSpace(p.data[p.pos]) && !isPdfDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// parseValue returns float64, bool, nil, string, pdfName, pdfRef, pdfDict
+// or pdfArray. Anything it cannot make sense of comes back as nil.
+func (p *pdfParser) parseValue(depth int) interface{} {
+	if depth > pdfMaxDepth {
+		return nil
+	}
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil
+	}
+	c := p.data[p.pos]
+	switch {
+	case c == '<' && p.pos+1 < len(p.data) && p.data[p.pos+1] == '<':
+		p.pos += 2
+		dict := make(pdfDict)
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.data) {
+				return dict
+			}
+			if p.data[p.pos] == '>' {
+				p.pos++
+				if p.pos < len(p.data) && p.data[p.pos] == '>' {
+					p.pos++
+				}
+				return dict
+			}
+			key, ok := p.parseValue(depth + 1).(pdfName)
+			if !ok {
+				return dict
+			}
+			dict[key] = p.parseValue(depth + 1)
+		}
+	case c == '<':
+		end := bytes.IndexByte(p.data[p.pos:], '>')
+		if end < 0 {
+			p.pos = len(p.data)
+			return nil
+		}
+		s := string(p.data[p.pos+1 : p.pos+end])
+		p.pos += end + 1
+		return s
+	case c == '[':
+		p.pos++
+		var arr pdfArray
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.data) {
+				return arr
+			}
+			if p.data[p.pos] == ']' {
+				p.pos++
+				return arr
+			}
+			before := p.pos
+			arr = append(arr, p.parseValue(depth+1))
+			if p.pos == before {
+				p.pos++
+			}
+		}
+	case c == '(':
+		start := p.pos + 1
+		nesting := 0
+		for p.pos++; p.pos < len(p.data); p.pos++ {
+			switch p.data[p.pos] {
+			case '\\':
+				p.pos++
+			case '(':
+				nesting++
+			case ')':
+				if nesting == 0 {
+					p.pos++
+					return string(p.data[start : p.pos-1])
+				}
+				nesting--
+			}
+		}
+		// an escape as the last byte steps past the end
+		p.pos = len(p.data)
+		return nil
+	case c == '/':
+		p.pos++
+		return pdfName(decodePdfName(p.readToken()))
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		n, err := strconv.ParseFloat(p.readToken(), 64)
+		if err != nil {
+			return nil
+		}
+		// look ahead for "gen R" to turn this into an indirect reference
+		save := p.pos
+		p.skipSpace()
+		gen := p.readToken()
+		p.skipSpace()
+		if g, err := strconv.Atoi(gen); err == nil && p.consumeKeyword("R") {
+			return pdfRef{num: int(n), gen: g}
+		}
+		p.pos = save
+		return n
+	default:
+		tok := p.readToken()
+		if tok == "" {
+			p.pos++
+			return nil
+		}
+		switch tok {
+		case "true":
+			return true
+		case "false":
+			return false
+		}
+		return nil
+	}
+}
+
+func decodePdfName(s string) string {
+	if bytes.IndexByte([]byte(s), '#') < 0 {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '#' && i+2 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				out = append(out, byte(b))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
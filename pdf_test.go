@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// buildPdf lays out objects 1..n with a classic cross-reference table.
+func buildPdf(objects ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// buildXrefStreamPdf lays out objects 1..n followed by a cross-reference
+// stream with the given dictionary entries and data.
+func buildXrefStreamPdf(dict string, data []byte, objects ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+	for i, obj := range objects {
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /XRef /Root 1 0 R %s /Length %d >>\nstream\n",
+		len(objects)+1, dict, len(data))
+	buf.Write(data)
+	fmt.Fprintf(&buf, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes()
+}
+
+func deflate(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func stream(dict string, data []byte) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+}
+
+var catalog = []string{
+	"<< /Type /Catalog /Pages 2 0 R >>",
+	"<< /Type /Pages /Kids [3 0 R] /Count 1 /MediaBox [0 0 612 792] >>",
+	"<< /Type /Page /Parent 2 0 R >>",
+}
+
+func TestProbePdf(t *testing.T) {
+	info, err := ProbePdf(buildPdf(catalog...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "1.4" || info.Pages != 1 || info.Width != 612 || info.Height != 792 {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestProbePdfXrefStream(t *testing.T) {
+	classic := buildPdf(catalog...)
+	// rows of type 1, a 4 byte offset and a 1 byte generation
+	var rows []byte
+	rows = append(rows, 0, 0, 0, 0, 0, 0)
+	for i := 1; i <= 3; i++ {
+		off := bytes.Index(classic, []byte(fmt.Sprintf("\n%d 0 obj", i))) + 1 - len("%PDF-1.4\n") + len("%PDF-1.5\n")
+		rows = append(rows, 1, byte(off>>24), byte(off>>16), byte(off>>8), byte(off), 0)
+	}
+	info, err := ProbePdf(buildXrefStreamPdf("/Size 5 /W [1 4 1]", rows, catalog...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Pages != 1 || info.Width != 612 {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestReadXrefStreamRejectsBadWidths(t *testing.T) {
+	for _, w := range []string{"[-10 20 0]", "[1 9 0]", "[1 2]", "[0 0 0]", "[1 2.5 0]", "[1 2 /X]"} {
+		b := buildXrefStreamPdf("/Size 2 /W "+w, make([]byte, 40), catalog...)
+		doc := newPdfDoc(b)
+		if err := doc.readXref(); err != errPdfSyntax {
+			t.Errorf("/W %s: got %v", w, err)
+		}
+	}
+}
+
+func TestReadXrefStreamRejectsBadIndex(t *testing.T) {
+	b := buildXrefStreamPdf("/Size 2 /W [1 1 1] /Index [-5 2]", make([]byte, 6), catalog...)
+	if err := newPdfDoc(b).readXref(); err != errPdfSyntax {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestProbePdfStreamBomb(t *testing.T) {
+	defer func(max int) { pdfMaxStreamSize = max }(pdfMaxStreamSize)
+	pdfMaxStreamSize = 1 << 16
+	bomb := deflate(make([]byte, 1<<20))
+	_, err := ProbePdf(buildXrefStreamPdf("/Size 2 /W [1 1 1] /Filter /FlateDecode", bomb, catalog...))
+	if ue, ok := err.(*uploadError); !ok || ue.Code != "pdf_stream_too_large" {
+		t.Errorf("xref stream: got %v", err)
+	}
+	objStm := stream("/Type /ObjStm /N 1 /First 4 /Filter /FlateDecode", bomb)
+	b := buildPdf("<< /Type /Catalog /Pages 2 0 R >>", objStm)
+	doc := newPdfDoc(b)
+	if err := doc.readXref(); err != nil {
+		t.Fatal(err)
+	}
+	doc.compressed[9] = pdfCompressedRef{stream: 2, index: 0}
+	doc.getObject(9)
+	if doc.err == nil || doc.err.Code != "pdf_stream_too_large" {
+		t.Errorf("object stream: got %v", doc.err)
+	}
+}
+
+func TestLoadObjStmBounds(t *testing.T) {
+	for name, objStm := range map[string]string{
+		"negative first":  stream("/Type /ObjStm /N 1 /First -5", []byte("9 0 << >>")),
+		"first past end":  stream("/Type /ObjStm /N 1 /First 500", []byte("9 0 << >>")),
+		"negative offset": stream("/Type /ObjStm /N 1 /First 4", []byte("9 -4 << >>")),
+		"offset past end": stream("/Type /ObjStm /N 1 /First 4", []byte("9 999 << >>")),
+		"huge count":      stream("/Type /ObjStm /N 1000000000 /First 4", []byte("9 0 << >>")),
+		"fractional":      stream("/Type /ObjStm /N 1.5 /First 4", []byte("9 0 << >>")),
+	} {
+		doc := newPdfDoc(buildPdf("<< /Type /Catalog >>", objStm))
+		if err := doc.readXref(); err != nil {
+			t.Fatal(err)
+		}
+		for _, index := range []int{0, -1, 5} {
+			doc.compressed[9] = pdfCompressedRef{stream: 2, index: index}
+			delete(doc.cache, 9)
+			if obj := doc.getObject(9); obj != nil {
+				t.Errorf("%s, index %d: got %v", name, index, obj)
+			}
+		}
+	}
+}
+
+func TestProbePdfMalformed(t *testing.T) {
+	valid := buildPdf(catalog...)
+	inputs := map[string][]byte{
+		"empty":             nil,
+		"no header":         []byte("hello"),
+		"header only":       []byte("%PDF-1.7"),
+		"truncated":         valid[:len(valid)/2],
+		"startxref garbage": append(append([]byte{}, valid...), []byte("startxref\n-99999999999999999999\n")...),
+		"startxref huge":    append(append([]byte{}, valid...), []byte("startxref\n1e308\n")...),
+		"unbalanced dict":   []byte("%PDF-1.4\n1 0 obj\n<< << << [ [ [\nendobj\ntrailer << /Root 1 0 R"),
+		"self reference":    []byte("%PDF-1.4\n1 0 obj\n1 0 R\nendobj\ntrailer\n<< /Root 1 0 R >>"),
+	}
+	for i := 0; i < len(valid); i += 7 {
+		inputs[fmt.Sprintf("cut at %d", i)] = valid[:i]
+	}
+	for name, b := range inputs {
+		_, err := ProbePdf(b)
+		if err != nil && strings.HasPrefix(err.Error(), "pdf parser:") {
+			t.Errorf("%s: parser panicked: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-martini/martini"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var progressHeartbeat string = "PROGRESS_HEARTBEAT"
+var progressHistory string = "PROGRESS_HISTORY"
+
+const (
+	progressChunkReceived   = "chunk.received"
+	progressFinalizeStarted = "finalize.started"
+	progressConverted       = "converted"
+	progressStored          = "stored"
+	progressCompleted       = "completed"
+	progressFailed          = "failed"
+)
+
+// progressBuffer is how many events a subscriber may fall behind before it
+// is dropped. Its client reconnects with Last-Event-ID and catches up from
+// the history.
+const progressBuffer = 64
+
+// progressHistoryLimit is how many events of a uuid are kept for replay.
+const progressHistoryLimit = 256
+
+// progressPruneInterval is how often idle history is looked for.
+const progressPruneInterval = time.Minute
+
+// ProgressEvent is one step of an upload under a uuid, sent as the data of
+// a server-sent event of the same type.
+type ProgressEvent struct {
+	ID             int64        `json:"id"`
+	Type           string       `json:"type"`
+	Uuid           string       `json:"uuid"`
+	FileName       string       `json:"file_name"`
+	ChunksReceived int          `json:"chunks_received,omitempty"`
+	TotalChunks    int          `json:"total_chunks,omitempty"`
+	From           string       `json:"from,omitempty"`
+	To             string       `json:"to,omitempty"`
+	Key            string       `json:"key,omitempty"`
+	Error          *uploadError `json:"error,omitempty"`
+	Retryable      bool         `json:"retryable,omitempty"`
+	Result         *ImageData   `json:"result,omitempty"`
+	At             time.Time    `json:"at"`
+}
+
+// progressHub fans the events of every uuid out to its subscribers. It is
+// in-process only: with several instances behind a load balancer a client
+// sees the uploads that reached the instance it is connected to.
+type progressHub struct {
+	sync.Mutex
+	lastID      int64
+	subscribers map[string]map[chan ProgressEvent]bool
+	history     map[string][]ProgressEvent
+}
+
+var progress = &progressHub{
+	subscribers: make(map[string]map[chan ProgressEvent]bool),
+	history:     make(map[string][]ProgressEvent),
+}
+
+var progressKeptFor = getEnvDuration(progressHistory, 10*time.Minute)
+
+func (h *progressHub) publish(event ProgressEvent) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastID++
+	event.ID = h.lastID
+	event.At = time.Now().UTC()
+	history := append(h.history[event.Uuid], event)
+	if len(history) > progressHistoryLimit {
+		history = history[len(history)-progressHistoryLimit:]
+	}
+	h.history[event.Uuid] = history
+	for ch := range h.subscribers[event.Uuid] {
+		select {
+		case ch <- event:
+		default:
+			delete(h.subscribers[event.Uuid], ch)
+			close(ch)
+		}
+	}
+}
+
+// forgetIdle drops the history of uuids without subscribers and without an
+// event for PROGRESS_HISTORY.
+func (h *progressHub) forgetIdle() {
+	h.Lock()
+	defer h.Unlock()
+	for uuidv4, history := range h.history {
+		last := history[len(history)-1]
+		if len(h.subscribers[uuidv4]) == 0 && time.Since(last.At) > progressKeptFor {
+			delete(h.history, uuidv4)
+		}
+	}
+}
+
+// subscribe returns the events of uuidv4 after lastID followed by a channel
+// of the new ones. An id from before a restart, when ids started over,
+// replays everything that is left.
+func (h *progressHub) subscribe(uuidv4 string, lastID int64) ([]ProgressEvent, chan ProgressEvent) {
+	h.Lock()
+	defer h.Unlock()
+	if lastID > h.lastID {
+		lastID = 0
+	}
+	var missed []ProgressEvent
+	for _, event := range h.history[uuidv4] {
+		if event.ID > lastID {
+			missed = append(missed, event)
+		}
+	}
+	ch := make(chan ProgressEvent, progressBuffer)
+	if h.subscribers[uuidv4] == nil {
+		h.subscribers[uuidv4] = make(map[chan ProgressEvent]bool)
+	}
+	h.subscribers[uuidv4][ch] = true
+	return missed, ch
+}
+
+func (h *progressHub) unsubscribe(uuidv4 string, ch chan ProgressEvent) {
+	h.Lock()
+	defer h.Unlock()
+	if h.subscribers[uuidv4][ch] {
+		delete(h.subscribers[uuidv4], ch)
+		close(ch)
+	}
+	if len(h.subscribers[uuidv4]) == 0 {
+		delete(h.subscribers, uuidv4)
+	}
+}
+
+func publishProgress(event ProgressEvent) {
+	progress.publish(event)
+}
+
+// pruneProgress forgets idle history every progressPruneInterval, rather
+// than on every event, which would scan every uuid for every chunk.
+func pruneProgress() {
+	for range time.Tick(progressPruneInterval) {
+		progress.forgetIdle()
+	}
+}
+
+// writeProgressEvent sends event to the client of r. The result of a
+// completed upload gets the URLs the upload response would have had.
+func writeProgressEvent(w http.ResponseWriter, r *http.Request, event ProgressEvent) error {
+	if event.Result != nil {
+		result := *event.Result
+		setObjectURLs(&result, r)
+		event.Result = &result
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// streamProgress is GET /:uuidv4/events, a server-sent event stream of the
+// uploads under the uuid from any tab or device. Comments are sent every
+// PROGRESS_HEARTBEAT to keep proxies from closing an idle stream.
+func streamProgress(params martini.Params, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	uuidv4 := params["uuidv4"]
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	missed, events := progress.subscribe(uuidv4, lastID)
+	defer progress.unsubscribe(uuidv4, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	for _, event := range missed {
+		if writeProgressEvent(w, r, event) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(getEnvDuration(progressHeartbeat, 15*time.Second))
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// fell behind, the client reconnects and catches up
+				return
+			}
+			if writeProgressEvent(w, r, event) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressForgetIdle(t *testing.T) {
+	defer func(d time.Duration) { progressKeptFor = d }(progressKeptFor)
+	progressKeptFor = time.Minute
+	h := &progressHub{
+		subscribers: make(map[string]map[chan ProgressEvent]bool),
+		history:     make(map[string][]ProgressEvent),
+	}
+	h.publish(ProgressEvent{Type: progressCompleted, Uuid: "idle"})
+	h.publish(ProgressEvent{Type: progressCompleted, Uuid: "watched"})
+	h.publish(ProgressEvent{Type: progressChunkReceived, Uuid: "recent"})
+	_, ch := h.subscribe("watched", 0)
+	for _, uuidv4 := range []string{"idle", "watched"} {
+		h.history[uuidv4][0].At = time.Now().Add(-time.Hour)
+	}
+
+	h.forgetIdle()
+	if _, ok := h.history["idle"]; ok {
+		t.Error("idle history was kept")
+	}
+	if _, ok := h.history["watched"]; !ok {
+		t.Error("history with a subscriber was dropped")
+	}
+	if _, ok := h.history["recent"]; !ok {
+		t.Error("recent history was dropped")
+	}
+
+	h.unsubscribe("watched", ch)
+	h.forgetIdle()
+	if _, ok := h.history["watched"]; ok {
+		t.Error("history was kept after its last subscriber left")
+	}
+}
+
+func TestProgressPublishKeepsHistory(t *testing.T) {
+	h := &progressHub{
+		subscribers: make(map[string]map[chan ProgressEvent]bool),
+		history:     make(map[string][]ProgressEvent),
+	}
+	h.publish(ProgressEvent{Type: progressCompleted, Uuid: "old"})
+	h.history["old"][0].At = time.Now().Add(-24 * time.Hour)
+	for i := 0; i < progressHistoryLimit+10; i++ {
+		h.publish(ProgressEvent{Type: progressChunkReceived, Uuid: "busy"})
+	}
+	if len(h.history["busy"]) != progressHistoryLimit {
+		t.Errorf("kept %d events", len(h.history["busy"]))
+	}
+	if _, ok := h.history["old"]; !ok {
+		t.Error("publish pruned history, that is left to pruneProgress")
+	}
+	missed, _ := h.subscribe("busy", h.lastID-3)
+	if len(missed) != 3 {
+		t.Errorf("replayed %d events", len(missed))
+	}
+}
+
+func TestProgressResultURLs(t *testing.T) {
+	defer func(s Storage, private bool) { storage, privateObjects = s, private }(storage, privateObjects)
+	storage = NewMemoryStorage("http://localhost/storage")
+	privateObjects = true
+	result := &ImageData{Uuid: "u1", Url: "u1/a.png"}
+	event := ProgressEvent{ID: 1, Type: progressCompleted, Uuid: "u1", Result: result}
+
+	w := httptest.NewRecorder()
+	if err := writeProgressEvent(w, httptest.NewRequest("GET", "/u1/events", nil), event); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(w.Body.String(), "\n")
+	if len(lines) < 3 || !strings.HasPrefix(lines[2], "data: ") {
+		t.Fatalf("event %q", w.Body.String())
+	}
+	var sent ProgressEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if !checkLocalSignature("u1/a.png", requestFor(t, sent.Result.Url)) || sent.Result.UrlExpiresAt == "" {
+		t.Errorf("result %+v is not signed like the upload response", sent.Result)
+	}
+	if result.Url != "u1/a.png" {
+		t.Errorf("published event changed to %s", result.Url)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var queueWorkers string = "QUEUE_WORKERS"
+var queuePollInterval string = "QUEUE_POLL_INTERVAL"
+var queueVisibilityTimeout string = "QUEUE_VISIBILITY_TIMEOUT"
+var queueMaxAttempts string = "QUEUE_MAX_ATTEMPTS"
+var queueBackoff string = "QUEUE_BACKOFF"
+var queueRetention string = "QUEUE_RETENTION"
+
+// maxQueueBackoff caps the exponential backoff between attempts.
+const maxQueueBackoff = time.Hour
+
+// QueuedJob is a row of queue_jobs, leased by a worker.
+type QueuedJob struct {
+	ID          int64
+	Queue       string
+	Payload     json.RawMessage
+	Attempts    int
+	MaxAttempts int
+	LockedBy    string
+}
+
+// errLeaseLost is returned when finishing a job whose lease ran out and
+// was taken by another worker, which now owns the outcome.
+var errLeaseLost = errors.New("lease lost to another worker")
+
+// QueueHandler does the work of a job. Returning an error retries the job
+// with backoff until it runs out of attempts and is dead-lettered.
+type QueueHandler func(job QueuedJob) error
+
+// EnqueueOptions schedule a job for later and limit its attempts, which
+// default to QUEUE_MAX_ATTEMPTS.
+type EnqueueOptions struct {
+	RunAt       time.Time
+	MaxAttempts int
+}
+
+var queueHandlers = make(map[string]QueueHandler)
+
+// RegisterQueueHandler makes the queue workers run handler for jobs on
+// queue. It must be called before the workers start.
+func RegisterQueueHandler(queue string, handler QueueHandler) {
+	queueHandlers[queue] = handler
+}
+
+// Enqueue adds a job to queue with payload marshalled as JSON. Jobs can be
+// enqueued from any instance, and any instance with a handler runs them.
+func Enqueue(db *sql.DB, queue string, payload interface{}, opts EnqueueOptions) (int64, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	if opts.RunAt.IsZero() {
+		opts.RunAt = time.Now()
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = getEnvInt(queueMaxAttempts, 10)
+	}
+	ctx, cancel := dbContext()
+	defer cancel()
+	var id int64
+	err = db.QueryRowContext(ctx, `insert into queue_jobs (queue, payload, run_at, max_attempts)
+		values ($1, $2, $3, $4) returning id`,
+		queue, string(body), opts.RunAt, opts.MaxAttempts).Scan(&id)
+	return id, err
+}
+
+// leaseJob takes the next job that is due on one of queues, or whose lease
+// ran out, and hides it from other workers for visibility. SKIP LOCKED
+// lets any number of instances lease at the same time without blocking on
+// each other. It returns false when there is nothing to do.
+func leaseJob(db *sql.DB, queues []string, worker string, visibility time.Duration) (QueuedJob, bool, error) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	var job QueuedJob
+	var payload []byte
+	err := db.QueryRowContext(ctx, `update queue_jobs set
+			state = 'running',
+			attempts = attempts + 1,
+			locked_by = $2,
+			locked_until = now() + $3 * interval '1 millisecond',
+			updated_at = now()
+		where id = (
+			select id from queue_jobs
+			where queue = any(string_to_array($1, ','))
+			and attempts < max_attempts
+			and ((state = 'queued' and run_at <= now())
+				or (state = 'running' and locked_until < now()))
+			order by run_at, id
+			limit 1
+			for update skip locked)
+		returning id, queue, payload, attempts, max_attempts`,
+		strings.Join(queues, ","), worker, int64(visibility/time.Millisecond)).Scan(
+		&job.ID, &job.Queue, &payload, &job.Attempts, &job.MaxAttempts)
+	if err == sql.ErrNoRows {
+		return job, false, nil
+	}
+	job.Payload = payload
+	job.LockedBy = worker
+	return job, err == nil, err
+}
+
+// leaseCondition matches the row of a job only while the lease it was
+// taken with still holds: a worker that outlived its lease must not undo
+// the attempt of the one that took the job over.
+const leaseCondition = `id = $1 and state = 'running' and locked_by = $2 and attempts = $3`
+
+// checkLease turns an update of no rows into errLeaseLost.
+func checkLease(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+func completeJob(db *sql.DB, job QueuedJob) error {
+	ctx, cancel := dbContext()
+	defer cancel()
+	return checkLease(db.ExecContext(ctx, `update queue_jobs set state = 'done', locked_until = null,
+		last_error = null, updated_at = now() where `+leaseCondition, job.ID, job.LockedBy, job.Attempts))
+}
+
+// failJob schedules another attempt after an exponential backoff, or
+// dead-letters the job once it has used up its attempts.
+func failJob(db *sql.DB, job QueuedJob, cause error) error {
+	ctx, cancel := dbContext()
+	defer cancel()
+	if job.Attempts >= job.MaxAttempts {
+		return checkLease(db.ExecContext(ctx, `update queue_jobs set state = 'dead', locked_until = null,
+			last_error = $4, updated_at = now() where `+leaseCondition,
+			job.ID, job.LockedBy, job.Attempts, cause.Error()))
+	}
+	return checkLease(db.ExecContext(ctx, `update queue_jobs set state = 'queued', locked_until = null,
+		last_error = $4, run_at = $5, updated_at = now() where `+leaseCondition,
+		job.ID, job.LockedBy, job.Attempts, cause.Error(), time.Now().Add(queueBackoffFor(job.Attempts))))
+}
+
+// queueBackoffFor is QUEUE_BACKOFF doubled for every attempt made so far,
+// give or take a tenth so retries of jobs that failed together spread out.
+func queueBackoffFor(attempts int) time.Duration {
+	base := getEnvDuration(queueBackoff, 5*time.Second)
+	backoff := time.Duration(float64(base) * math.Pow(2, float64(attempts-1)))
+	if backoff > maxQueueBackoff || backoff <= 0 {
+		backoff = maxQueueBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff)/5+1)) - backoff/10
+	return backoff + jitter
+}
+
+// sweepQueue dead-letters jobs whose last lease ran out on their final
+// attempt, which leaseJob no longer picks up, and forgets finished jobs
+// after QUEUE_RETENTION.
+func sweepQueue(db *sql.DB) error {
+	ctx, cancel := dbContext()
+	defer cancel()
+	_, err := db.ExecContext(ctx, `update queue_jobs set state = 'dead', locked_until = null,
+			last_error = coalesce(last_error, 'lease expired'), updated_at = now()
+		where state = 'running' and locked_until < now() and attempts >= max_attempts`)
+	if err != nil {
+		return err
+	}
+	retention := getEnvDuration(queueRetention, 7*24*time.Hour)
+	_, err = db.ExecContext(ctx, `delete from queue_jobs where state = 'done' and updated_at < $1`,
+		time.Now().Add(-retention))
+	return err
+}
+
+// startQueueWorkers runs QUEUE_WORKERS workers for the registered
+// handlers. They share the pool with requests, so DB_MAX_OPEN_CONNS should
+// leave room for them.
+func startQueueWorkers() {
+	n := getEnvInt(queueWorkers, 1)
+	if n <= 0 || len(queueHandlers) == 0 || os.Getenv("IMAGES_POSTGRESQL_DATABASE_STRING") == "" {
+		return
+	}
+	var queues []string
+	for queue := range queueHandlers {
+		queues = append(queues, queue)
+	}
+	host, _ := os.Hostname()
+	for i := 0; i < n; i++ {
+		go queueWorker(queues, host+":"+strconv.Itoa(os.Getpid())+":"+strconv.Itoa(i))
+	}
+}
+
+func queueWorker(queues []string, worker string) {
+	db := getDB()
+	poll := getEnvDuration(queuePollInterval, time.Second)
+	visibility := getEnvDuration(queueVisibilityTimeout, 5*time.Minute)
+	lastSweep := time.Time{}
+	for {
+		if time.Since(lastSweep) > time.Minute {
+			if err := sweepQueue(db); err != nil {
+				fmt.Println("Could not sweep queue", err)
+			}
+			lastSweep = time.Now()
+		}
+		job, ok, err := leaseJob(db, queues, worker, visibility)
+		if err != nil {
+			fmt.Println("Could not lease job", err)
+		}
+		if !ok {
+			time.Sleep(poll)
+			continue
+		}
+		runQueuedJob(db, job)
+	}
+}
+
+func runQueuedJob(db *sql.DB, job QueuedJob) {
+	err := recoverError(func() error {
+		return queueHandlers[job.Queue](job)
+	})
+	if err == nil {
+		err = completeJob(db, job)
+		if err == errLeaseLost {
+			fmt.Println("Job", job.ID, "finished after its lease ran out, another worker has it")
+		} else if err != nil {
+			fmt.Println("Could not complete job", job.ID, err)
+		}
+		return
+	}
+	fmt.Println("Job", job.ID, "on", job.Queue, "failed attempt", job.Attempts, err)
+	if err := failJob(db, job, err); err == errLeaseLost {
+		fmt.Println("Job", job.ID, "failed after its lease ran out, another worker has it")
+	} else if err != nil {
+		fmt.Println("Could not fail job", job.ID, err)
+	}
+}
+
+// queueCommand runs "queue status" and "queue retry <queue>", which puts
+// the dead jobs of queue back to work.
+func queueCommand(args []string) {
+	db := getDB()
+	if len(args) == 0 || args[0] == "status" {
+		rows, err := db.Query(`select queue, state, count(*) from queue_jobs group by queue, state order by queue, state`)
+		if err != nil {
+			panic(err.Error())
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var queue, state string
+			var count int
+			if err := rows.Scan(&queue, &state, &count); err != nil {
+				panic(err.Error())
+			}
+			fmt.Printf("%-20s %-8s %d\n", queue, state, count)
+		}
+		if err := rows.Err(); err != nil {
+			panic(err.Error())
+		}
+		return
+	}
+	if args[0] == "retry" && len(args) == 2 {
+		result, err := db.Exec(`update queue_jobs set state = 'queued', attempts = 0, run_at = now(),
+			updated_at = now() where queue = $1 and state = 'dead'`, args[1])
+		if err != nil {
+			panic(err.Error())
+		}
+		n, _ := result.RowsAffected()
+		fmt.Println("Requeued", n, "dead jobs on", args[1])
+		return
+	}
+	fmt.Println("Usage: go-flow-s3 queue [status | retry <queue>]")
+	os.Exit(1)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+func TestCheckLease(t *testing.T) {
+	if err := checkLease(driver.RowsAffected(1), nil); err != nil {
+		t.Errorf("held lease: %v", err)
+	}
+	if err := checkLease(driver.RowsAffected(0), nil); err != errLeaseLost {
+		t.Errorf("lost lease: %v", err)
+	}
+	failed := errors.New("connection refused")
+	if err := checkLease(nil, failed); err != failed {
+		t.Errorf("failed update: %v", err)
+	}
+}
@@ -7,8 +7,7 @@ gosu postgres pg_ctl -w start
 echo "create database"
 gosu postgres createdb images
 
-echo "initializing tables"
-gosu postgres psql -h localhost -p 5432 -U postgres -d images -a -f /db/vault.sql
+# tables are created by "go-flow-s3 migrate up", or on start with MIGRATE_ON_START
 
 echo "stopping postgres"
 gosu postgres pg_ctl stop
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mitchellh/goamz/aws"
+	"net/http"
+	"time"
+)
+
+var finalizeRetryTotal string = "FINALIZE_RETRY_TOTAL"
+var finalizeRetryDelay string = "FINALIZE_RETRY_DELAY"
+var finalizeRetryMin string = "FINALIZE_RETRY_MIN"
+
+// finalizeRetryAfter is the Retry-After, in seconds, sent with a
+// finalization that ran out of attempts.
+const finalizeRetryAfter = 5
+
+// finalizeAttempts bounds how long a request keeps retrying the storage
+// and database writes of a finished upload. Delay is the first wait, it
+// doubles after every failure.
+var finalizeAttempts = aws.AttemptStrategy{
+	Total: getEnvDuration(finalizeRetryTotal, 20*time.Second),
+	Delay: getEnvDuration(finalizeRetryDelay, 250*time.Millisecond),
+	Min:   getEnvInt(finalizeRetryMin, 3),
+}
+
+// ioError is a failure to reach storage or the database. Anything else,
+// like an image that cannot be decoded, fails the same way every time.
+type ioError struct {
+	err error
+}
+
+func (e *ioError) Error() string {
+	return e.err.Error()
+}
+
+// ioFailure marks err as an ioError, unless it is nil or already reports
+// what was wrong with the upload.
+func ioFailure(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch err.(type) {
+	case *uploadError, *ioError:
+		return err
+	}
+	return &ioError{err}
+}
+
+// retryable is only true for storage and database errors.
+func retryable(err error) bool {
+	_, ok := err.(*ioError)
+	return ok
+}
+
+// retryWithBackoff calls fn until it succeeds, fails with an error that is
+// not retryable, or strategy runs out. Like an aws.Attempt it makes at
+// least strategy.Min attempts, but the delay between them grows
+// exponentially.
+func retryWithBackoff(strategy aws.AttemptStrategy, fn func() error) error {
+	deadline := time.Now().Add(strategy.Total)
+	delay := strategy.Delay
+	for count := 1; ; count++ {
+		err := fn()
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if count >= strategy.Min && !time.Now().Add(delay).Before(deadline) {
+			return err
+		}
+		fmt.Println("Attempt", count, "failed, retrying in", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// recoverError turns a panic in fn into an error, so a retry loop can
+// carry on after code that reports failures by panicking. Panics with an
+// ioError keep it, any other is an upload that cannot be processed.
+func recoverError(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(*ioError); ok {
+				err = e
+				return
+			}
+			fmt.Println("Recovered", r)
+			err = newUploadError(http.StatusUnprocessableEntity, "unprocessable_upload",
+				"the upload could not be processed")
+		}
+	}()
+	return fn()
+}
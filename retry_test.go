@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"github.com/mitchellh/goamz/aws"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"storage", ioFailure(errors.New("connection reset by peer")), true},
+		{"database", ioFailure(errors.New("pq: the database system is starting up")), true},
+		{"marked twice", ioFailure(ioFailure(errors.New("timeout"))), true},
+		{"plain", errors.New("unexpected EOF"), false},
+		{"too large", newUploadError(http.StatusRequestEntityTooLarge, "image_too_large", "too large"), false},
+		{"invalid", newUploadError(http.StatusUnprocessableEntity, "invalid_image", "bad png"), false},
+		{"server", newUploadError(http.StatusInternalServerError, "finalize_failed", "oops"), false},
+		{"upload error kept", ioFailure(newUploadError(http.StatusUnprocessableEntity, "invalid_svg", "bad")), false},
+		{"panic", recoverError(func() error { panic("index out of range") }), false},
+		{"panic with storage error", recoverError(func() error { panic(ioFailure(errors.New("timeout"))) }), true},
+		{"nil", ioFailure(nil), false},
+	} {
+		if got := retryable(test.err); got != test.want {
+			t.Errorf("%s: retryable(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestRecoverErrorIsUploadError(t *testing.T) {
+	err := recoverError(func() error { panic(errors.New("nil map")) })
+	ue, ok := err.(*uploadError)
+	if !ok || ue.Status != http.StatusUnprocessableEntity {
+		t.Fatalf("got %#v", err)
+	}
+}
+
+func TestBoltFailureIsRetried(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv(boltChunks, os.Getenv(boltChunks))
+	os.Setenv(boltChunks, filepath.Join(dir, "missing", "chunks.db"))
+
+	calls := 0
+	strategy := aws.AttemptStrategy{Total: 50 * time.Millisecond, Delay: time.Millisecond, Min: 3}
+	err = retryWithBackoff(strategy, func() error {
+		return recoverError(func() error {
+			calls++
+			(&FlowFile{name: "uf"}).AssembleChunks()
+			return nil
+		})
+	})
+	if _, ok := err.(*uploadError); ok || !retryable(err) {
+		t.Fatalf("unreadable chunk store gave %#v", err)
+	}
+	if calls < 3 {
+		t.Errorf("tried %d times", calls)
+	}
+}
+
+func TestRetryWithBackoffStopsOnInvalidUpload(t *testing.T) {
+	calls := 0
+	strategy := aws.AttemptStrategy{Total: time.Second, Delay: time.Millisecond, Min: 3}
+	retryWithBackoff(strategy, func() error {
+		calls++
+		return newUploadError(http.StatusUnprocessableEntity, "invalid_image", "bad png")
+	})
+	if calls != 1 {
+		t.Errorf("invalid upload tried %d times", calls)
+	}
+	calls = 0
+	retryWithBackoff(strategy, func() error {
+		calls++
+		return ioFailure(errors.New("timeout"))
+	})
+	if calls < 3 {
+		t.Errorf("storage error tried %d times", calls)
+	}
+}
+
+func TestConvertToJpegFromPngRejectsCorruptData(t *testing.T) {
+	// a valid header followed by garbage instead of IDAT
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00\x90wS\xde")
+	png = append(png, "garbage"...)
+	_, err := ConvertToJpegFromPng(png)
+	if ue, ok := err.(*uploadError); !ok || ue.Status != http.StatusUnprocessableEntity {
+		t.Fatalf("got %v", err)
+	}
+	if retryable(err) {
+		t.Error("corrupt png is retryable")
+	}
+}
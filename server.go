@@ -1,47 +1,63 @@
 package main
 
 import (
-	"crypto/sha256"
-	"database/sql"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/go-martini/martini"
 	_ "github.com/lib/pq"
 	"github.com/martini-contrib/cors"
-	"github.com/mitchellh/goamz/aws"
-	"github.com/mitchellh/goamz/s3"
 	"github.com/nu7hatch/gouuid"
+	"github.com/wlaurance/go-flow-s3/listener"
 	"io/ioutil"
 	"log"
+	"math"
 	"mime"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var skipUpload string = os.Getenv("SKIP_S3_UPLOAD")
 var boltChunks string = "BOLT_CHUNKS"
 
-var s3Bucket string = "S3_BUCKET"
 var cloudfrontURL string = os.Getenv("CLOUDFRONT_URL")
 
-func init() {
-	bChunks := os.Getenv(boltChunks)
-	if bChunks == "" {
-		log.Fatal(fmt.Sprintf("Please define %s in your environment.", boltChunks))
-	}
-	_, err := aws.EnvAuth()
-	if err != nil {
-		log.Fatal(err)
-	}
-	if os.Getenv(s3Bucket) == "" {
-		log.Fatal(fmt.Sprintf("Please define a S3 bucket with %s", s3Bucket))
+// setup opens the storage backend. It runs in main rather than init so
+// tests can load the package without it.
+func setup() {
+	dryRun = isDryRunMode(skipUpload)
+	if dryRun {
+		storage = newDryRunStorage(skipUpload)
+	} else {
+		storage = newStorageFromEnv()
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		// commands go through whole tables, which takes longer than a request
+		queryTimeout = 0
+		switch os.Args[1] {
+		case "rotate-keys":
+			rotateEnvelopeKeys()
+		case "queue":
+			queueCommand(os.Args[2:])
+		case "migrate":
+			migrateCommand(os.Args[2:])
+		default:
+			log.Fatal(fmt.Sprintf("Unknown command %q, use rotate-keys, queue or migrate.", os.Args[1]))
+		}
+		return
+	}
+	// only the server keeps chunks and objects, commands just need the
+	// database
+	if os.Getenv(boltChunks) == "" {
+		log.Fatal(fmt.Sprintf("Please define %s in your environment.", boltChunks))
+	}
+	setup()
+	checkSchema()
 	m := martini.Classic()
 	m.Use(cors.Allow(&cors.Options{
 		AllowOrigins:     []string{"*"},
@@ -54,29 +70,128 @@ func main() {
 		defer func() {
 			if r := recover(); r != nil {
 				fmt.Println("Recovered in Post", r)
+				if ue, ok := r.(*uploadError); ok {
+					ue.write(w)
+				}
 			}
 		}()
 		streamHandler(chunkedReader)(w, params, r)
 	})
 	m.Get("/:uuidv4", validateUUID(), continueUpload)
+	m.Get("/:uuidv4/events", validateUUID(), streamProgress)
+	go pruneProgress()
+	if asyncFinalize() {
+		m.Get("/:uuidv4/jobs/:id", validateUUID(), getJobStatus)
+		startFinalizeWorkers()
+	}
+	if len(webhookEndpoints) > 0 && os.Getenv(webhookLogToken) != "" {
+		m.Get("/:uuidv4/webhooks", validateUUID(), getWebhookDeliveries)
+	}
+	startQueueWorkers()
+	if h, ok := storage.(http.Handler); ok {
+		m.Get(storageRoute+"/**", h.ServeHTTP)
+		m.Head(storageRoute+"/**", h.ServeHTTP)
+	}
+	if encryptObjects() {
+		m.Get("/:uuidv4"+objectsRoute+"/**", validateUUID(), serveDecrypted)
+		m.Head("/:uuidv4"+objectsRoute+"/**", validateUUID(), serveDecrypted)
+	}
 
-	m.Get("/:uuidv4/urls", validateUUID(), func(params martini.Params, w http.ResponseWriter) {
+	m.Get("/:uuidv4/urls", validateUUID(), func(params martini.Params, w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if r := recover(); r != nil {
 				fmt.Println("Recovered in local file retrievel", r)
 			}
 		}()
-		var urls []string
-		urls = getBucketUrls(params["uuidv4"])
-		if len(urls) == 0 {
+		query, err := parseFileQuery(r.URL.Query(), 0)
+		if err != nil {
+			err.(*uploadError).write(w)
+			return
+		}
+		urls, next := getBucketUrls(params["uuidv4"], query)
+		if len(urls) == 0 && !query.narrowed() {
 			http.Error(w, "Buckets urls not found", http.StatusNotFound)
 		} else {
+			setNextLink(w, r, next)
+			if urlsExpire() || encryptObjects() {
+				for i := range urls {
+					urls[i], _ = objectURL(params["uuidv4"], urls[i], r)
+				}
+			}
 			w.Header().Set("Content-Type", "application/json")
 			list, _ := json.Marshal(urls)
 			w.Write(list)
 		}
 	})
 
+	m.Get("/:uuidv4/files", validateUUID(), getFiles)
+
+	// reissues time limited URLs for a private bucket, the expiry lets
+	// clients know when to come back
+	m.Get("/:uuidv4/urls/refresh", validateUUID(), func(params martini.Params, w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Println("Recovered in url refresh", r)
+			}
+		}()
+		if !urlsExpire() {
+			http.Error(w, "Objects are public, urls do not expire", http.StatusNotFound)
+			return
+		}
+		keys, _ := getBucketUrls(params["uuidv4"], FileQuery{})
+		if len(keys) == 0 {
+			http.Error(w, "Buckets urls not found", http.StatusNotFound)
+			return
+		}
+		var refreshed struct {
+			Urls      []string `json:"urls"`
+			ExpiresAt string   `json:"expires_at"`
+		}
+		var expires time.Time
+		for _, key := range keys {
+			var signed string
+			signed, expires = objectURL(params["uuidv4"], key, r)
+			refreshed.Urls = append(refreshed.Urls, signed)
+		}
+		refreshed.ExpiresAt = expires.UTC().Format(time.RFC3339)
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := json.Marshal(refreshed)
+		w.Write(body)
+	})
+
+	// authorizes a whole gallery at once with CloudFront signed cookies
+	m.Get("/:uuidv4/cookies", validateUUID(), func(params martini.Params, w http.ResponseWriter, r *http.Request) {
+		if !usingCloudFrontSigning() {
+			http.Error(w, "CloudFront signing is not configured", http.StatusNotFound)
+			return
+		}
+		ip := ""
+		if restrictToClientIP {
+			ip = clientIP(r)
+		}
+		expires := time.Now().Add(urlExpiry)
+		prefix, ok := keyTemplate.UuidPrefix(params["uuidv4"])
+		if !ok {
+			http.Error(w, "Object keys do not start with the uuid", http.StatusNotFound)
+			return
+		}
+		resource := computeFullUrlFromPath(prefix + "/*")
+		cookies, err := cloudfrontSigner.SignedCookies(resource, expires, ip)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, cookie := range cookies {
+			http.SetCookie(w, cookie)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := json.Marshal(map[string]string{
+			"resource":   resource,
+			"expires_at": expires.UTC().Format(time.RFC3339),
+		})
+		w.Write(body)
+	})
+
 	m.Run()
 }
 
@@ -125,14 +240,35 @@ func chunkedReader(w http.ResponseWriter, params martini.Params, r *http.Request
 		if err != nil {
 			panic(err.Error())
 		}
-		if ff.NumberOfChunks() == cT {
-			defer ff.Delete()
-			imageStruct, err := exportFlowFile(ff, params["uuidv4"], r)
+		received := ff.NumberOfChunks()
+		publishProgress(ProgressEvent{
+			Type:           progressChunkReceived,
+			Uuid:           params["uuidv4"],
+			FileName:       ff.FileName(r),
+			ChunksReceived: received,
+			TotalChunks:    cT,
+		})
+		if received == cT {
+			if asyncFinalize() {
+				writeJobAccepted(w, enqueueFinalize(ff, params["uuidv4"], ff.FileName(r)))
+				return
+			}
+			imageStruct, err := finalizeFlowFile(ff, params["uuidv4"], ff.FileName(r))
+			notifyFinalized(params["uuidv4"], ff.FileName(r), imageStruct, err)
+			if err != nil && !retryable(err) {
+				ff.Delete()
+				panic(err)
+			}
 			if err != nil {
-				panic(err.Error())
+				// the chunks stay, so resending the last one finishes the upload
+				fmt.Println("Could not finalize upload, keeping chunks", err)
+				w.Header().Set("Retry-After", strconv.Itoa(finalizeRetryAfter))
+				newUploadError(http.StatusServiceUnavailable, "finalize_failed",
+					"The upload could not be stored, send the last chunk again to retry").write(w)
+				return
 			}
-			storeAttributes(imageStruct)
-			imageStruct.Url = computeFullUrlFromPath(imageStruct.Url)
+			ff.Delete()
+			setObjectURLs(&imageStruct, r)
 			imageStructBytes, err := json.Marshal(imageStruct)
 			if err != nil {
 				panic(err.Error())
@@ -143,96 +279,353 @@ func chunkedReader(w http.ResponseWriter, params martini.Params, r *http.Request
 	}
 }
 
+// setObjectURLs swaps the stored keys of imageData for the URLs handed to
+// the client of r.
+func setObjectURLs(imageData *ImageData, r *http.Request) {
+	var expires time.Time
+	imageData.Url, expires = objectURL(imageData.Uuid, imageData.Url, r)
+	if imageData.PosterUrl != "" {
+		imageData.PosterUrl, _ = objectURL(imageData.Uuid, imageData.PosterUrl, r)
+	}
+	if !expires.IsZero() {
+		imageData.UrlExpiresAt = expires.UTC().Format(time.RFC3339)
+	}
+}
+
+// finalizeFlowFile stores the assembled upload and its database row,
+// retrying both with finalizeAttempts. Objects that were already stored
+// are skipped by storeObject on the next attempt.
+func finalizeFlowFile(ff *FlowFile, uuidv4, name string) (ImageData, error) {
+	publishProgress(ProgressEvent{Type: progressFinalizeStarted, Uuid: uuidv4, FileName: name})
+	var imageData ImageData
+	err := retryWithBackoff(finalizeAttempts, func() error {
+		return recoverError(func() error {
+			var err error
+			imageData, err = exportFlowFile(ff, uuidv4, name)
+			if err != nil {
+				return err
+			}
+			return ioFailure(storeAttributes(&imageData))
+		})
+	})
+	if err != nil {
+		publishProgress(ProgressEvent{
+			Type:      progressFailed,
+			Uuid:      uuidv4,
+			FileName:  name,
+			Error:     asUploadError(err),
+			Retryable: retryable(err),
+		})
+	} else {
+		// keys, writeProgressEvent makes the URLs for each subscriber
+		result := imageData
+		publishProgress(ProgressEvent{Type: progressCompleted, Uuid: uuidv4, FileName: name, Result: &result})
+	}
+	return imageData, err
+}
+
+// publishStored reports that key of the upload name is in storage.
+func publishStored(uuidv4, name, key string) {
+	publishProgress(ProgressEvent{Type: progressStored, Uuid: uuidv4, FileName: name, Key: key})
+}
+
 func computeFullUrlFromPath(path string) string {
 	var fullURL string
-	if cloudfrontURL != "" {
+	if cloudfrontURL != "" && !dryRun {
 		cloudfrontURL = strings.TrimSuffix(cloudfrontURL, "/")
 		fullURL = cloudfrontURL + "/" + path
 	} else {
-		auth, err := aws.EnvAuth()
-		if err != nil {
-			log.Fatal(err)
-		}
-		client := s3.New(auth, aws.USEast)
-		bucket := client.Bucket(os.Getenv(s3Bucket))
-		fullURL = bucket.URL(path)
+		fullURL = storage.URL(path)
 	}
 	return fullURL
 }
 
-func getDB() *sql.DB {
-	connstring := os.Getenv("IMAGES_POSTGRESQL_DATABASE_STRING")
-	db, err := sql.Open("postgres", connstring)
+// storeAttributes upserts the row of imageData and sets its ID and
+// CreatedAt, which are kept when the same file is stored again.
+func storeAttributes(imageData *ImageData) error {
+	uuidv4, url, height, width := imageData.Uuid, imageData.Url, imageData.Height, imageData.Width
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := dbContext()
+	defer cancel()
+	tx, err := getDB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var createdAt time.Time
+	err = tx.QueryRowContext(ctx, `insert into images
+		(id, uuid, url, height, width, kind, original_name, size, mime_type, sha256, conversion, metadata)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		on conflict (uuid, url) do update set height = excluded.height, width = excluded.width,
+			kind = excluded.kind, original_name = excluded.original_name, size = excluded.size,
+			mime_type = excluded.mime_type, sha256 = excluded.sha256, conversion = excluded.conversion,
+			metadata = excluded.metadata
+		returning id, created_at`,
+		id.String(), uuidv4, url, height, width, imageData.Kind, imageData.OriginalName, imageData.Size,
+		imageData.MimeType, imageData.Sha256, imageData.Conversion, imageData.probeMetadata()).Scan(
+		&imageData.ID, &createdAt)
+	if err == nil {
+		imageData.CreatedAt = &createdAt
+		err = notifyEvent(ctx, tx, listener.Event{Type: listener.Stored, Uuid: uuidv4, Url: url, Height: height, Width: width})
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// getBucketUrls returns the keys of a page of files and the cursor of the
+// next page, see fileRecords.
+func getBucketUrls(uuidv4 string, query FileQuery) ([]string, string) {
+	files, next, err := fileRecords(uuidv4, query)
 	if err != nil {
 		panic(err.Error())
 	}
-	return db
+	urls := []string{}
+	for _, imageData := range files {
+		urls = append(urls, imageData.Url)
+	}
+	return urls, next
 }
 
-func storeAttributes(imageData ImageData) {
-	db := getDB()
-	defer db.Close()
-	uuidv4, url, height, width := imageData.Uuid, imageData.Url, imageData.Height, imageData.Width
-	_, err := db.Query("insert into images (uuid, url, height, width) values ($1, $2, $3, $4)", uuidv4, url, height, width)
+// exportFlowFile stores the assembled chunks of ff, uploaded as name.
+func exportFlowFile(ff *FlowFile, uuidv4, name string) (ImageData, error) {
+	rawBytes := ff.AssembleChunks()
+	if fileExtension(name) == ".svg" {
+		return exportSvg(ff, uuidv4, name, rawBytes)
+	}
+	if !isImageExtension(fileExtension(name)) {
+		return exportFile(ff, uuidv4, name, rawBytes)
+	}
+	return exportImage(ff, uuidv4, name, rawBytes)
+}
+
+// exportSvg only ever stores the sanitized document, since it is served
+// from our own domain and would otherwise be a stored XSS.
+func exportSvg(ff *FlowFile, uuidv4, name string, rawBytes []byte) (ImageData, error) {
+	svgBytes, svgInfo, err := SanitizeSvg(rawBytes)
 	if err != nil {
-		panic(err.Error())
+		return ImageData{}, err
 	}
+	digest := sha256Hex(svgBytes)
+	fullFilePath := objectKey(KeyFields{
+		Uuid:         uuidv4,
+		Sha256:       digest,
+		Ext:          "svg",
+		Preset:       presetOriginal,
+		OriginalName: name,
+		Time:         ff.StartedAt(),
+	})
+	mimeType := "image/svg+xml"
+	headers := objectHeaders(mimeType, StorageObject{
+		Preset: presetOriginal,
+		Kind:   kindImage,
+		Size:   int64(len(svgBytes)),
+	})
+	deduplicated, envelope, err := storeObject(fullFilePath, svgBytes, headers)
+	if err != nil {
+		return ImageData{}, err
+	}
+	publishStored(uuidv4, name, fullFilePath)
+	svgData := ImageData{
+		Kind:         kindImage,
+		Url:          fullFilePath,
+		Uuid:         uuidv4,
+		Height:       int(math.Ceil(svgInfo.Height)),
+		Width:        int(math.Ceil(svgInfo.Width)),
+		OriginalName: name,
+		Size:         int64(len(svgBytes)),
+		MimeType:     mimeType,
+		Sha256:       digest,
+		Conversion:   conversionSanitizedSvg,
+		Deduplicated: deduplicated,
+		Svg:          &svgInfo,
+	}
+	svgData.addEnvelope(fullFilePath, envelope)
+	return svgData, nil
 }
 
-func getBucketUrls(uuidv4 string) []string {
-	db := getDB()
-	rows, err := db.Query("select url from images where uuid = $1", uuidv4)
+// exportFile stores anything that is not an image as-is. Only videos are
+// probed for dimensions, see probeFileMetadata.
+func exportFile(ff *FlowFile, uuidv4, name string, fileBytes []byte) (ImageData, error) {
+	fileExt := fileExtension(name)
+	originalName := name
+	digest := sha256Hex(fileBytes)
+	keyFields := KeyFields{
+		Uuid:         uuidv4,
+		Sha256:       digest,
+		Ext:          strings.TrimPrefix(fileExt, "."),
+		Preset:       presetOriginal,
+		OriginalName: originalName,
+		Time:         ff.StartedAt(),
+	}
+	fullFilePath := fileObjectKey(keyFields)
+	fileData := ImageData{
+		Kind:         kindFile,
+		Url:          fullFilePath,
+		Uuid:         uuidv4,
+		OriginalName: originalName,
+		Size:         int64(len(fileBytes)),
+		MimeType:     detectMimeType(fileExt, fileBytes),
+		Sha256:       digest,
+	}
+	if isVideoExtension(fileExt) {
+		fileData.Kind = kindVideo
+		fullFilePath = objectKey(keyFields)
+		fileData.Url = fullFilePath
+		fileData.MimeType = videoMimeTypes[fileExt]
+	}
+	if err := probeFileMetadata(&fileData, fileBytes); err != nil {
+		return ImageData{}, err
+	}
+	headers := objectHeaders(fileData.MimeType, StorageObject{
+		Preset: presetOriginal,
+		Kind:   fileData.Kind,
+		Size:   int64(len(fileBytes)),
+	})
+	if fileData.Kind == kindFile {
+		headers["Content-Disposition"] = []string{contentDisposition(originalName)}
+	}
+	deduplicated, envelope, err := storeObject(fullFilePath, fileBytes, headers)
 	if err != nil {
-		panic(err.Error())
+		return ImageData{}, err
 	}
-	var urls []string
-	for rows.Next() {
-		var s string
-		rows.Scan(&s)
-		urls = append(urls, s)
+	publishStored(uuidv4, name, fullFilePath)
+	fileData.Deduplicated = deduplicated
+	fileData.addEnvelope(fullFilePath, envelope)
+	return fileData, nil
+}
+
+// probeFileMetadata fills in format specific details for non-image files.
+// Probing is best effort: a file we cannot parse is still a valid upload,
+// the returned error is only for files that break a configured limit, or
+// that cannot be checked against one.
+func probeFileMetadata(fileData *ImageData, fileBytes []byte) error {
+	if strings.HasPrefix(fileData.MimeType, "application/pdf") {
+		pdfInfo, err := ProbePdf(fileBytes)
+		if ue, ok := err.(*uploadError); ok {
+			return ue
+		}
+		if err != nil {
+			fmt.Println("Could not probe pdf", fileData.Url, err)
+		}
+		if pdfInfo.Version != "" {
+			fileData.Pdf = &pdfInfo
+		}
+	}
+	if fileData.Kind == kindVideo {
+		videoInfo, err := ProbeVideo(fileBytes)
+		if err != nil && videoMaxDuration > 0 {
+			return newUploadError(http.StatusUnprocessableEntity, "invalid_video",
+				"could not read video: %s", err.Error())
+		}
+		if err != nil {
+			fmt.Println("Could not probe video", fileData.Url, err)
+			return nil
+		}
+		fileData.Width = videoInfo.Width
+		fileData.Height = videoInfo.Height
+		fileData.DurationMs = videoInfo.DurationMs
+		fileData.Video = &videoInfo
+		return checkVideoDuration(videoInfo)
 	}
-	return urls
+	return nil
 }
 
-func exportFlowFile(ff *FlowFile, uuidv4 string, r *http.Request) (ImageData, error) {
-	imageRawBytes := ff.AssembleChunks()
-	oldFileExt := ff.FileExtension(r)
-	fileExt := ff.FileExtension(r)
+func exportImage(ff *FlowFile, uuidv4, name string, imageRawBytes []byte) (ImageData, error) {
+	oldFileExt := fileExtension(name)
+	fileExt := fileExtension(name)
+	imageConfig, err := GetImageConfigFromBytesAndType(oldFileExt, imageRawBytes)
+	if err != nil {
+		return ImageData{}, err
+	}
+	var gifInfo GifInfo
+	if oldFileExt == ".gif" {
+		gifInfo, err = InspectGif(imageRawBytes)
+		if err != nil {
+			return ImageData{}, err
+		}
+	}
 	var imageBytes []byte
+	conversion := ""
 	if fileExt == ".png" {
-		imageBytes = ConvertToJpegFromPng(imageRawBytes)
+		imageBytes, err = ConvertToJpegFromPng(imageRawBytes)
+		if err != nil {
+			return ImageData{}, err
+		}
 		fileExt = ".jpeg"
+		conversion = conversionPngToJpeg
+		publishProgress(ProgressEvent{Type: progressConverted, Uuid: uuidv4, FileName: name, From: "png", To: "jpeg"})
 	} else {
 		imageBytes = imageRawBytes
 	}
-	hash := sha256.New()
-	hash.Write(imageBytes)
-	md := hash.Sum(nil)
-	fileName := hex.EncodeToString(md)
-	filePath := fileName + fileExt
-	fullFilePath := fmt.Sprintf("%s/%s", uuidv4, filePath)
-	auth, err := aws.EnvAuth()
-	if err != nil {
-		log.Fatal(err)
-	}
-	client := s3.New(auth, aws.USEast)
-	bucket := client.Bucket(os.Getenv(s3Bucket))
+	fileName := sha256Hex(imageBytes)
+	fullFilePath := objectKey(KeyFields{
+		Uuid:         uuidv4,
+		Sha256:       fileName,
+		Ext:          strings.TrimPrefix(fileExt, "."),
+		Preset:       presetOriginal,
+		OriginalName: name,
+		Time:         ff.StartedAt(),
+	})
 	mimeType := mime.TypeByExtension(fileExt)
-	headers := map[string][]string{
-		"Content-Type":  {mimeType},
-		"Cache-Control": {"max-age=31536000"},
-	}
-	putError := bucket.PutHeader(fullFilePath, imageBytes, headers, s3.PublicRead)
+	headers := objectHeaders(mimeType, StorageObject{
+		Preset: presetOriginal,
+		Kind:   kindImage,
+		Size:   int64(len(imageBytes)),
+	})
+	deduplicated, envelope, putError := storeObject(fullFilePath, imageBytes, headers)
 	if putError != nil {
 		return ImageData{}, putError
 	}
+	publishStored(uuidv4, name, fullFilePath)
 
-	imageConfig := GetImageConfigFromBytesAndType(oldFileExt, imageRawBytes)
-
-	return ImageData{
-		Url:    fullFilePath,
-		Uuid:   uuidv4,
-		Height: imageConfig.Height,
-		Width:  imageConfig.Width,
-	}, nil
+	imageData := ImageData{
+		Kind:         kindImage,
+		Url:          fullFilePath,
+		Uuid:         uuidv4,
+		Height:       imageConfig.Height,
+		Width:        imageConfig.Width,
+		OriginalName: name,
+		Size:         int64(len(imageBytes)),
+		MimeType:     mimeType,
+		Sha256:       fileName,
+		Conversion:   conversion,
+		Deduplicated: deduplicated,
+	}
+	imageData.addEnvelope(fullFilePath, envelope)
+	if gifInfo.Frames > 0 {
+		imageData.Frames = gifInfo.Frames
+		imageData.DurationMs = int64(gifInfo.Duration / time.Millisecond)
+		if gifPolicy.Poster {
+			posterBytes, err := gifInfo.Poster()
+			if err != nil {
+				return ImageData{}, err
+			}
+			posterPath := objectKey(KeyFields{
+				Uuid:         uuidv4,
+				Sha256:       sha256Hex(posterBytes),
+				Ext:          "jpeg",
+				Preset:       presetPoster,
+				OriginalName: name,
+				Time:         ff.StartedAt(),
+			})
+			posterHeaders := objectHeaders(mime.TypeByExtension(".jpeg"), StorageObject{
+				Preset: presetPoster,
+				Kind:   kindImage,
+				Size:   int64(len(posterBytes)),
+			})
+			_, posterEnvelope, putError := storeObject(posterPath, posterBytes, posterHeaders)
+			if putError != nil {
+				return ImageData{}, putError
+			}
+			publishStored(uuidv4, name, posterPath)
+			imageData.PosterUrl = posterPath
+			imageData.addEnvelope(posterPath, posterEnvelope)
+		}
+	}
+	return imageData, nil
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var s3SSE string = "S3_SSE"
+var s3SSEKMSKeyID string = "S3_SSE_KMS_KEY_ID"
+var s3SSECustomerKey string = "S3_SSE_C_KEY"
+
+const (
+	sseS3       = "AES256"
+	sseKMS      = "aws:kms"
+	sseCustomer = "SSE-C"
+)
+
+// ServerSideEncryption is how S3 encrypts objects at rest: with S3 managed
+// keys, with a KMS key, or with a key we supply on every request.
+type ServerSideEncryption struct {
+	Mode        string
+	KMSKeyID    string
+	CustomerKey []byte
+}
+
+var serverSideEncryption = loadServerSideEncryption()
+
+func loadServerSideEncryption() ServerSideEncryption {
+	sse, err := NewServerSideEncryption(os.Getenv(s3SSE), os.Getenv(s3SSEKMSKeyID), os.Getenv(s3SSECustomerKey))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return sse
+}
+
+// NewServerSideEncryption checks the settings for mode, which is empty for
+// no encryption, "AES256", "aws:kms" or "SSE-C". customerKey is a base64
+// encoded 256 bit key.
+func NewServerSideEncryption(mode, kmsKeyID, customerKey string) (ServerSideEncryption, error) {
+	sse := ServerSideEncryption{KMSKeyID: kmsKeyID}
+	switch strings.ToLower(mode) {
+	case "":
+	case "aes256", "s3":
+		sse.Mode = sseS3
+	case "aws:kms", "kms":
+		sse.Mode = sseKMS
+	case "sse-c", "customer":
+		sse.Mode = sseCustomer
+	default:
+		return sse, fmt.Errorf("unknown %s %q, use AES256, aws:kms or SSE-C", s3SSE, mode)
+	}
+	if kmsKeyID != "" && sse.Mode != sseKMS {
+		return sse, fmt.Errorf("%s needs %s=aws:kms", s3SSEKMSKeyID, s3SSE)
+	}
+	if sse.Mode == sseCustomer {
+		key, err := base64.StdEncoding.DecodeString(customerKey)
+		if err != nil || len(key) != 32 {
+			return sse, fmt.Errorf("%s must be a base64 encoded 256 bit key", s3SSECustomerKey)
+		}
+		sse.CustomerKey = key
+	} else if customerKey != "" {
+		return sse, fmt.Errorf("%s needs %s=SSE-C", s3SSECustomerKey, s3SSE)
+	}
+	return sse, nil
+}
+
+// needsSigV4 is true for KMS, which S3 refuses to serve or accept over the
+// signature version 2 requests goamz makes, and for SSE-C, whose key goes
+// with every request while goamz only sends extra headers with a PUT.
+func (sse ServerSideEncryption) needsSigV4() bool {
+	return sse.Mode == sseKMS || sse.Mode == sseCustomer
+}
+
+// headers are the x-amz headers a PUT needs for sse.
+func (sse ServerSideEncryption) headers() map[string][]string {
+	headers := make(map[string][]string)
+	switch sse.Mode {
+	case sseS3:
+		headers["x-amz-server-side-encryption"] = []string{sseS3}
+	case sseKMS:
+		headers["x-amz-server-side-encryption"] = []string{sseKMS}
+		if sse.KMSKeyID != "" {
+			headers["x-amz-server-side-encryption-aws-kms-key-id"] = []string{sse.KMSKeyID}
+		}
+	case sseCustomer:
+		sum := md5.Sum(sse.CustomerKey)
+		headers["x-amz-server-side-encryption-customer-algorithm"] = []string{"AES256"}
+		headers["x-amz-server-side-encryption-customer-key"] = []string{base64.StdEncoding.EncodeToString(sse.CustomerKey)}
+		headers["x-amz-server-side-encryption-customer-key-md5"] = []string{base64.StdEncoding.EncodeToString(sum[:])}
+	}
+	return headers
+}
+
+// readHeaders are the x-amz headers a GET or HEAD needs for sse. Only SSE-C
+// objects cannot be read without them.
+func (sse ServerSideEncryption) readHeaders() map[string][]string {
+	if sse.Mode != sseCustomer {
+		return map[string][]string{}
+	}
+	return sse.headers()
+}
+
+// copyHeaders are the x-amz headers a copy needs for sse: the source is
+// read with the same key the copy is written with.
+func (sse ServerSideEncryption) copyHeaders() map[string][]string {
+	headers := sse.headers()
+	for k, v := range sse.readHeaders() {
+		headers[strings.Replace(k, "x-amz-", "x-amz-copy-source-", 1)] = v
+	}
+	return headers
+}
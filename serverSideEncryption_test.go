@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 records the requests it gets and answers 200, or 404 for
+// missing.
+type fakeS3 struct {
+	sync.Mutex
+	requests []*http.Request
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	f.requests = append(f.requests, r)
+	f.Unlock()
+	if strings.HasSuffix(r.URL.Path, "/missing") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>"))
+		return
+	}
+	if r.Method == "GET" && r.URL.Path == "/bucket/" {
+		w.Write([]byte("<ListBucketResult><Contents><Key>a/b.png</Key><Size>3</Size></Contents></ListBucketResult>"))
+		return
+	}
+	w.Header().Set("Content-Length", "3")
+	w.Write([]byte("abc"))
+}
+
+func newFakeS3Storage(t *testing.T, sse ServerSideEncryption) (*fakeS3, Storage, func()) {
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	region, err := S3RegionFor("us-east-1", server.URL, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := s3.New(aws.Auth{AccessKey: "access", SecretKey: "secret"}, region)
+	return fake, NewS3Storage(client.Bucket("bucket"), s3.Private, sse, false), server.Close
+}
+
+func TestSSECustomerKeyOnEveryRequest(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	sse, err := NewServerSideEncryption("SSE-C", "", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake, storage, done := newFakeS3Storage(t, sse)
+	defer done()
+
+	if err := storage.Put("a/b.png", []byte("abc"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Head("a/b.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Head("a/missing"); err != ErrObjectNotFound {
+		t.Errorf("head of a missing object: %v", err)
+	}
+	body, _, err := storage.Get("a/b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if err := storage.Copy("a/b.png", "a/c.png"); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range fake.requests {
+		if r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key") != key {
+			t.Errorf("%s %s without the customer key", r.Method, r.URL.Path)
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), sigV4Algorithm) {
+			t.Errorf("%s %s not signed with version 4", r.Method, r.URL.Path)
+		}
+	}
+	copy := fake.requests[len(fake.requests)-1]
+	if copy.Header.Get("X-Amz-Copy-Source") != "/bucket/a/b.png" ||
+		copy.Header.Get("X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key") != key {
+		t.Errorf("copy headers %v", copy.Header)
+	}
+}
+
+func TestKMSSignsEveryRequestWithSigV4(t *testing.T) {
+	sse, err := NewServerSideEncryption("aws:kms", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake, storage, done := newFakeS3Storage(t, sse)
+	defer done()
+
+	storage.Put("a/b.png", []byte("abc"), nil)
+	storage.Head("a/b.png")
+	body, _, err := storage.Get("a/b.png")
+	if err == nil {
+		body.Close()
+	}
+	storage.Delete("a/b.png")
+	objects, err := storage.List("a/")
+	if err != nil || len(objects) != 1 || objects[0].Key != "a/b.png" {
+		t.Errorf("list: %v %v", objects, err)
+	}
+	if len(fake.requests) != 5 {
+		t.Fatalf("%d requests", len(fake.requests))
+	}
+	for _, r := range fake.requests {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), sigV4Algorithm) {
+			t.Errorf("%s %s not signed with version 4", r.Method, r.URL.Path)
+		}
+		if r.Method != "PUT" && r.Header.Get("X-Amz-Server-Side-Encryption") != "" {
+			t.Errorf("%s %s sent the KMS headers", r.Method, r.URL.Path)
+		}
+	}
+}
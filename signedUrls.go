@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var privateBucket string = "PRIVATE_BUCKET"
+var signedURLExpiry string = "SIGNED_URL_EXPIRY"
+var storageSigningKey string = "STORAGE_SIGNING_KEY"
+
+// privateObjects stores everything without public read access and hands
+// out time limited URLs instead.
+var privateObjects = getEnvBool(privateBucket, false)
+
+var urlExpiry = getEnvDuration(signedURLExpiry, time.Hour)
+
+// localSigningKey signs URLs for the backends this server serves itself.
+// Without STORAGE_SIGNING_KEY a random key is used, so those URLs stop
+// working when the server restarts.
+var localSigningKey = loadStorageSigningKey()
+
+func loadStorageSigningKey() []byte {
+	if key := os.Getenv(storageSigningKey); key != "" {
+		return []byte(key)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// objectURL is the URL handed to the client of r for key: permanent when
+// objects are public, otherwise signed and valid until the returned time.
+// CloudFront signing takes precedence over presigned storage URLs, and
+// encrypted objects are always fetched through this server. r is nil for
+// URLs sent in webhooks, which are then not restricted to a client IP.
+func objectURL(uuidv4, key string, r *http.Request) (string, time.Time) {
+	if encryptObjects() {
+		return decryptingURL(uuidv4, key, r)
+	}
+	if !urlsExpire() {
+		return computeFullUrlFromPath(key), time.Time{}
+	}
+	expires := time.Now().Add(urlExpiry)
+	if usingCloudFrontSigning() {
+		ip := ""
+		if restrictToClientIP && r != nil {
+			ip = clientIP(r)
+		}
+		signed, err := cloudfrontSigner.SignURL(computeFullUrlFromPath(key), expires, ip)
+		if err != nil {
+			panic(err)
+		}
+		return signed, expires
+	}
+	return storage.SignedURL(key, expires), expires
+}
+
+func urlsExpire() bool {
+	return privateObjects || (usingCloudFrontSigning() && !encryptObjects())
+}
+
+func localSignature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, localSigningKey)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signLocalURL adds expires and signature parameters to a URL served from
+// storageRoute, the counterpart of checkLocalSignature.
+func signLocalURL(baseURL, key string, expires time.Time) string {
+	unix := expires.Unix()
+	query := url.Values{
+		"expires":   {strconv.FormatInt(unix, 10)},
+		"signature": {localSignature(key, unix)},
+	}
+	return baseURL + "/" + key + "?" + query.Encode()
+}
+
+func checkLocalSignature(key string, r *http.Request) bool {
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	signature := r.URL.Query().Get("signature")
+	return hmac.Equal([]byte(signature), []byte(localSignature(key, expires)))
+}
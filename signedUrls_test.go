@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func requestFor(t *testing.T, signed string) *http.Request {
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewRequest("GET", u.RequestURI(), nil)
+}
+
+func TestLocalSignature(t *testing.T) {
+	signed := signLocalURL("http://localhost/storage", "u/a.png", time.Now().Add(time.Minute))
+	r := requestFor(t, signed)
+	if key := storageKeyFromRequest(r); key != "u/a.png" {
+		t.Fatalf("key %s", key)
+	}
+	if !checkLocalSignature("u/a.png", r) {
+		t.Error("rejected a valid signature")
+	}
+	if checkLocalSignature("u/b.png", r) {
+		t.Error("signature accepted for another key")
+	}
+
+	query := r.URL.Query()
+	expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+	for name, tamper := range map[string]func(url.Values){
+		"later expiry":    func(q url.Values) { q.Set("expires", strconv.FormatInt(expires+3600, 10)) },
+		"other signature": func(q url.Values) { q.Set("signature", localSignature("u/b.png", expires)) },
+		"no signature":    func(q url.Values) { q.Del("signature") },
+		"no expiry":       func(q url.Values) { q.Del("expires") },
+	} {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		tamper(q)
+		tampered := httptest.NewRequest("GET", "/storage/u/a.png?"+q.Encode(), nil)
+		if checkLocalSignature("u/a.png", tampered) {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	expired := requestFor(t, signLocalURL("http://localhost/storage", "u/a.png", time.Now().Add(-time.Second)))
+	if checkLocalSignature("u/a.png", expired) {
+		t.Error("accepted an expired URL")
+	}
+}
+
+func TestServePrivateObjects(t *testing.T) {
+	defer func(private bool) { privateObjects = private }(privateObjects)
+	privateObjects = true
+	s := NewMemoryStorage("http://localhost/storage")
+	s.Put("u/a.png", []byte("png"), nil)
+	h := s.(http.Handler)
+
+	other := requestFor(t, s.SignedURL("u/b.png", time.Now().Add(time.Minute)))
+	for name, target := range map[string]string{
+		"unsigned": "/storage/u/a.png",
+		"expired":  requestFor(t, s.SignedURL("u/a.png", time.Now().Add(-time.Minute))).RequestURI,
+		"other":    "/storage/u/a.png?" + other.URL.RawQuery,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: got %d", name, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, requestFor(t, s.SignedURL("u/a.png", time.Now().Add(time.Minute))))
+	if w.Code != http.StatusOK || w.Body.String() != "png" {
+		t.Errorf("signed: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestObjectURL(t *testing.T) {
+	defer func(s Storage, private bool) { storage, privateObjects = s, private }(storage, privateObjects)
+	storage = NewMemoryStorage("http://localhost/storage")
+
+	privateObjects = false
+	if u, expires := objectURL("u", "u/a.png", nil); u != "http://localhost/storage/u/a.png" || !expires.IsZero() {
+		t.Errorf("public: %s %v", u, expires)
+	}
+	privateObjects = true
+	u, expires := objectURL("u", "u/a.png", nil)
+	if d := expires.Sub(time.Now()); d < urlExpiry-time.Minute || d > urlExpiry {
+		t.Errorf("expires in %s", d)
+	}
+	if !checkLocalSignature("u/a.png", requestFor(t, u)) {
+		t.Errorf("private url %s does not verify", u)
+	}
+}
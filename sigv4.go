@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/mitchellh/goamz/aws"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// goamz only speaks signature version 2. S3 insists on version 4 for KMS
+// encrypted objects and in newer regions, so those requests and their
+// presigned URLs are signed here instead.
+
+const (
+	sigV4Algorithm       = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat      = "20060102T150405Z"
+	sigV4UnsignedPayload = "UNSIGNED-PAYLOAD"
+	sigV4MaxExpiry       = 7 * 24 * time.Hour
+)
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sigV4Scope(now time.Time, region string) string {
+	return now.Format("20060102") + "/" + region + "/s3/aws4_request"
+}
+
+func sigV4Signature(auth aws.Auth, now time.Time, region, canonicalRequest string) string {
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		now.Format(sigV4TimeFormat),
+		sigV4Scope(now, region),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+auth.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// sigV4Query is the canonical query string: sorted by key, with spaces
+// encoded as %20 rather than +.
+func sigV4Query(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+// signV4 adds an Authorization header to req, whose body hashes to
+// payloadHash. Every header already set on req is signed.
+func signV4(req *http.Request, auth aws.Auth, region, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if auth.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", auth.Token)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders []string
+	for _, k := range names {
+		canonicalHeaders = append(canonicalHeaders, k+":"+headers[k]+"\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		sigV4Query(req.URL.Query()),
+		strings.Join(canonicalHeaders, ""),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", sigV4Algorithm+
+		" Credential="+auth.AccessKey+"/"+sigV4Scope(now, region)+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+sigV4Signature(auth, now, region, canonicalRequest))
+}
+
+// presignV4 returns rawURL with a version 4 query signature for a GET that
+// is valid until expires, which S3 caps at a week from now.
+func presignV4(rawURL string, auth aws.Auth, region string, now, expires time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	now = now.UTC()
+	ttl := expires.Sub(now)
+	if ttl > sigV4MaxExpiry {
+		ttl = sigV4MaxExpiry
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", auth.AccessKey+"/"+sigV4Scope(now, region))
+	query.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt(int64(ttl/time.Second), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if auth.Token != "" {
+		query.Set("X-Amz-Security-Token", auth.Token)
+	}
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		sigV4Query(query),
+		"host:" + u.Host + "\n",
+		"host",
+		sigV4UnsignedPayload,
+	}, "\n")
+	u.RawQuery = sigV4Query(query) + "&X-Amz-Signature=" + sigV4Signature(auth, now, region, canonicalRequest)
+	return u.String(), nil
+}
@@ -5,29 +5,35 @@ import (
 	"image"
 	"image/jpeg"
 	"image/png"
+	"net/http"
 )
 
-func getImageConfigFromJpegBytes(b []byte) image.Config {
-	config, err := jpeg.DecodeConfig(bytes.NewReader(b))
-	if err != nil {
-		panic(err)
-	}
-	return config
+func getImageConfigFromJpegBytes(b []byte) (image.Config, error) {
+	return jpeg.DecodeConfig(bytes.NewReader(b))
 }
 
-func getImageConfigFromPngBytes(b []byte) image.Config {
-	config, err := png.DecodeConfig(bytes.NewReader(b))
-	if err != nil {
-		panic(err)
-	}
-	return config
+func getImageConfigFromPngBytes(b []byte) (image.Config, error) {
+	return png.DecodeConfig(bytes.NewReader(b))
 }
 
-func GetImageConfigFromBytesAndType(t string, b []byte) image.Config {
-	if t == ".jpg" {
-		return getImageConfigFromJpegBytes(b)
+// GetImageConfigFromBytesAndType reads only the image header and checks the
+// declared dimensions against imageLimits, so nothing oversized is ever
+// handed to a full decoder.
+func GetImageConfigFromBytesAndType(t string, b []byte) (image.Config, error) {
+	var config image.Config
+	var err error
+	if t == ".jpg" || t == ".jpeg" {
+		config, err = getImageConfigFromJpegBytes(b)
 	} else if t == ".png" {
-		return getImageConfigFromPngBytes(b)
+		config, err = getImageConfigFromPngBytes(b)
+	} else if t == ".gif" {
+		config, err = getImageConfigFromGifBytes(b)
+	} else {
+		return image.Config{}, nil
+	}
+	if err != nil {
+		return config, newUploadError(http.StatusUnprocessableEntity, "invalid_image",
+			"could not read %s header: %s", t, err.Error())
 	}
-	return image.Config{}
+	return config, imageLimits.Check(config)
 }
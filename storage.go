@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var storageBackend string = "STORAGE_BACKEND"
+var storageBaseURL string = "STORAGE_BASE_URL"
+
+// storageRoute is where the local and memory backends serve their objects.
+const storageRoute = "/storage"
+
+var ErrObjectNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	Header       http.Header
+}
+
+// Storage is where finished uploads end up. Keys are slash separated paths
+// such as "uuid/sha256.ext", see validKey. Get and Head return
+// ErrObjectNotFound for missing keys.
+type Storage interface {
+	Put(key string, data []byte, headers map[string][]string) error
+	Get(key string) (io.ReadCloser, ObjectInfo, error)
+	Head(key string) (ObjectInfo, error)
+	Delete(key string) error
+	List(prefix string) ([]ObjectInfo, error)
+	Copy(srcKey, dstKey string) error
+	URL(key string) string
+	SignedURL(key string, expires time.Time) string
+}
+
+var storage Storage
+
+func newStorageFromEnv() Storage {
+	switch backend := os.Getenv(storageBackend); backend {
+	case "", "s3":
+		return newS3StorageFromEnv()
+	case "local":
+		return newLocalStorageFromEnv()
+	case "memory":
+		return NewMemoryStorage(defaultStorageBaseURL())
+	default:
+		log.Fatal(fmt.Sprintf("Unknown %s %q, use s3, local or memory.", storageBackend, backend))
+	}
+	return nil
+}
+
+// validKey rejects keys that are not plain relative paths: empty, absolute,
+// with backslashes or with empty, "." or ".." segments. The local backend
+// would otherwise be walked out of its directory, and the others are held
+// to the same rules so a key that works on one works on all of them.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.ContainsAny(key, "\\\x00") {
+		return fmt.Errorf("invalid storage key %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid storage key %q", key)
+		}
+	}
+	return nil
+}
+
+// defaultStorageBaseURL points at storageRoute on this server, for the
+// backends that serve objects themselves.
+func defaultStorageBaseURL() string {
+	if base := os.Getenv(storageBaseURL); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+	return "http://localhost:" + port + storageRoute
+}
+
+// serveObject writes an object from s with the headers it was stored with.
+// Private objects need a URL from signLocalURL.
+func serveObject(s Storage, key string, w http.ResponseWriter, r *http.Request) {
+	if privateObjects && !checkLocalSignature(key, r) {
+		http.Error(w, "URL expired or not signed", http.StatusForbidden)
+		return
+	}
+	body, info, err := s.Get(key)
+	if err == ErrObjectNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+	for k, v := range info.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("ETag", info.ETag)
+	if r.Method != "HEAD" {
+		io.Copy(w, body)
+	}
+}
+
+func storageKeyFromRequest(r *http.Request) string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, storageRoute), "/")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var s3StorageClass string = "S3_STORAGE_CLASS"
+var s3StorageClassRules string = "S3_STORAGE_CLASS_RULES"
+
+// storageClasses are the classes objects can be read from straight away.
+// GLACIER and DEEP_ARCHIVE need a restore before any URL works.
+var storageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER_IR":          true,
+}
+
+// StorageObject describes an object about to be stored, for picking its
+// storage class.
+type StorageObject struct {
+	Preset string
+	Kind   string
+	Size   int64
+}
+
+type storageClassCondition func(StorageObject) bool
+
+type storageClassRule struct {
+	conditions []storageClassCondition
+	class      string
+}
+
+// StorageClassRules picks the x-amz-storage-class of an object. The first
+// rule whose conditions all match wins, otherwise Default is used, and an
+// empty class leaves it to the bucket.
+type StorageClassRules struct {
+	Default string
+	rules   []storageClassRule
+}
+
+var storageClassRules = loadStorageClassRules()
+
+func loadStorageClassRules() *StorageClassRules {
+	rules, err := ParseStorageClassRules(os.Getenv(s3StorageClass), os.Getenv(s3StorageClassRules))
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Invalid %s: %s", s3StorageClassRules, err.Error()))
+	}
+	return rules
+}
+
+var sizeCondition = regexp.MustCompile(`^SIZE(<=|>=|<|>)(\d+)(B|KB|MB|GB)?$`)
+
+var sizeUnits = map[string]int64{"": 1, "B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30}
+
+// ParseStorageClassRules reads rules such as
+// "original&size>=50MB:STANDARD_IA,poster:REDUCED_REDUNDANCY". A condition
+// is a preset (original, poster), "derivative" for anything but the
+// original, a kind (image, video, file) or a size comparison.
+func ParseStorageClassRules(def, spec string) (*StorageClassRules, error) {
+	def = strings.ToUpper(def)
+	if def != "" && !storageClasses[def] {
+		return nil, fmt.Errorf("unsupported storage class %q", def)
+	}
+	scr := &StorageClassRules{Default: def}
+	for _, r := range strings.Split(spec, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		i := strings.LastIndex(r, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("rule %q has no storage class, e.g. original:STANDARD_IA", r)
+		}
+		rule := storageClassRule{class: strings.ToUpper(strings.TrimSpace(r[i+1:]))}
+		if !storageClasses[rule.class] {
+			return nil, fmt.Errorf("unsupported storage class %q", rule.class)
+		}
+		for _, c := range strings.Split(r[:i], "&") {
+			condition, err := parseStorageClassCondition(strings.TrimSpace(c))
+			if err != nil {
+				return nil, err
+			}
+			rule.conditions = append(rule.conditions, condition)
+		}
+		scr.rules = append(scr.rules, rule)
+	}
+	return scr, nil
+}
+
+func parseStorageClassCondition(c string) (storageClassCondition, error) {
+	switch c {
+	case presetOriginal, presetPoster:
+		return func(o StorageObject) bool { return o.Preset == c }, nil
+	case "derivative":
+		return func(o StorageObject) bool { return o.Preset != presetOriginal }, nil
+	case kindImage, kindVideo, kindFile:
+		return func(o StorageObject) bool { return o.Kind == c }, nil
+	}
+	m := sizeCondition.FindStringSubmatch(strings.ToUpper(strings.Replace(c, " ", "", -1)))
+	if m == nil {
+		return nil, fmt.Errorf("unknown condition %q", c)
+	}
+	n, _ := strconv.ParseInt(m[2], 10, 64)
+	limit := n * sizeUnits[m[3]]
+	switch m[1] {
+	case "<":
+		return func(o StorageObject) bool { return o.Size < limit }, nil
+	case "<=":
+		return func(o StorageObject) bool { return o.Size <= limit }, nil
+	case ">":
+		return func(o StorageObject) bool { return o.Size > limit }, nil
+	default:
+		return func(o StorageObject) bool { return o.Size >= limit }, nil
+	}
+}
+
+func (scr *StorageClassRules) ClassFor(o StorageObject) string {
+	for _, rule := range scr.rules {
+		matched := true
+		for _, condition := range rule.conditions {
+			if !condition(o) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return rule.class
+		}
+	}
+	return scr.Default
+}
+
+// objectHeaders are the headers every stored object gets: its type, a long
+// cache lifetime and the storage class picked for it.
+func objectHeaders(contentType string, o StorageObject) map[string][]string {
+	headers := map[string][]string{
+		"Content-Type":  {contentType},
+		"Cache-Control": {"max-age=31536000"},
+	}
+	if class := storageClassRules.ClassFor(o); class != "" {
+		headers["x-amz-storage-class"] = []string{class}
+	}
+	return headers
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var localStorageDir string = "LOCAL_STORAGE_DIR"
+
+// headers for each object are kept in a parallel tree under this directory
+const localHeaderDir = ".headers"
+
+// localStorage keeps objects as plain files under dir, so an on-prem
+// deployment can back it with any mounted volume.
+type localStorage struct {
+	dir     string
+	baseURL string
+}
+
+func NewLocalStorage(dir, baseURL string) (Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localStorage{dir: dir, baseURL: baseURL}, nil
+}
+
+func newLocalStorageFromEnv() Storage {
+	dir := os.Getenv(localStorageDir)
+	if dir == "" {
+		log.Fatal(fmt.Sprintf("Please define %s in your environment.", localStorageDir))
+	}
+	ls, err := NewLocalStorage(dir, defaultStorageBaseURL())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ls
+}
+
+// paths also keeps keys out of the header tree, on top of validKey.
+func (ls *localStorage) paths(key string) (string, string, error) {
+	if err := validKey(key); err != nil {
+		return "", "", err
+	}
+	if key == localHeaderDir || strings.HasPrefix(key, localHeaderDir+"/") {
+		return "", "", fmt.Errorf("invalid storage key %q", key)
+	}
+	dataPath := filepath.Join(ls.dir, filepath.FromSlash(key))
+	headerPath := filepath.Join(ls.dir, localHeaderDir, filepath.FromSlash(key)+".json")
+	return dataPath, headerPath, nil
+}
+
+func writeFileAtomic(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (ls *localStorage) Put(key string, data []byte, headers map[string][]string) error {
+	dataPath, headerPath, err := ls.paths(key)
+	if err != nil {
+		return err
+	}
+	header := storedHeader(headers)
+	header.Set("ETag", etagFor(data))
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(headerPath, headerBytes); err != nil {
+		return err
+	}
+	return writeFileAtomic(dataPath, data)
+}
+
+func (ls *localStorage) info(key, dataPath, headerPath string) (ObjectInfo, error) {
+	stat, err := os.Stat(dataPath)
+	if os.IsNotExist(err) {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	header := make(http.Header)
+	if headerBytes, err := ioutil.ReadFile(headerPath); err == nil {
+		json.Unmarshal(headerBytes, &header)
+	}
+	etag := header.Get("ETag")
+	header.Del("ETag")
+	if etag == "" {
+		// written by hand rather than through Put
+		data, err := ioutil.ReadFile(dataPath)
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		etag = etagFor(data)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ETag:         etag,
+		LastModified: stat.ModTime(),
+		Header:       header,
+	}, nil
+}
+
+func (ls *localStorage) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	dataPath, headerPath, err := ls.paths(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := ls.info(key, dataPath, headerPath)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(dataPath)
+	if os.IsNotExist(err) {
+		return nil, ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return f, info, nil
+}
+
+func (ls *localStorage) Head(key string) (ObjectInfo, error) {
+	dataPath, headerPath, err := ls.paths(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ls.info(key, dataPath, headerPath)
+}
+
+func (ls *localStorage) Delete(key string) error {
+	dataPath, headerPath, err := ls.paths(key)
+	if err != nil {
+		return err
+	}
+	os.Remove(headerPath)
+	err = os.Remove(dataPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (ls *localStorage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.Walk(ls.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(ls.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if fi.IsDir() {
+			if key == localHeaderDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".tmp-") || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		dataPath, headerPath, err := ls.paths(key)
+		if err != nil {
+			return err
+		}
+		info, err := ls.info(key, dataPath, headerPath)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(objectsByKey(objects))
+	return objects, nil
+}
+
+func (ls *localStorage) Copy(srcKey, dstKey string) error {
+	body, info, err := ls.Get(srcKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return ls.Put(dstKey, data, info.Header)
+}
+
+func (ls *localStorage) URL(key string) string {
+	return ls.baseURL + "/" + key
+}
+
+func (ls *localStorage) SignedURL(key string, expires time.Time) string {
+	return signLocalURL(ls.baseURL, key, expires)
+}
+
+func (ls *localStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveObject(ls, storageKeyFromRequest(r), w, r)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var s3Bucket string = "S3_BUCKET"
+var s3Region string = "S3_REGION"
+var s3Endpoint string = "S3_ENDPOINT"
+var s3PathStyle string = "S3_PATH_STYLE"
+var s3SignatureV4 string = "S3_SIGNATURE_V4"
+
+// sigV4OnlyRegions opened after signature version 2 was retired and refuse
+// anything else.
+var sigV4OnlyRegions = map[string]bool{
+	"eu-central-1":   true,
+	"cn-north-1":     true,
+	"ap-northeast-2": true,
+	"ap-south-1":     true,
+	"us-east-2":      true,
+	"ca-central-1":   true,
+	"eu-west-2":      true,
+}
+
+type s3Storage struct {
+	bucket *s3.Bucket
+	acl    s3.ACL
+	sse    ServerSideEncryption
+	sigV4  bool
+}
+
+// NewS3Storage signs every request with signature version 4 when sigV4 is
+// true or sse needs it, and otherwise leaves signing to goamz.
+func NewS3Storage(bucket *s3.Bucket, acl s3.ACL, sse ServerSideEncryption, sigV4 bool) Storage {
+	return &s3Storage{bucket: bucket, acl: acl, sse: sse, sigV4: sigV4 || sse.needsSigV4()}
+}
+
+func newS3StorageFromEnv() Storage {
+	auth, err := aws.EnvAuth()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if os.Getenv(s3Bucket) == "" {
+		log.Fatal(fmt.Sprintf("Please define a S3 bucket with %s", s3Bucket))
+	}
+	sigV4 := getEnvBool(s3SignatureV4, false) || serverSideEncryption.needsSigV4()
+	region, err := S3RegionFor(os.Getenv(s3Region), os.Getenv(s3Endpoint), getEnvBool(s3PathStyle, true), sigV4)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := s3.New(auth, region)
+	return NewS3Storage(client.Bucket(os.Getenv(s3Bucket)), objectACL(), serverSideEncryption, sigV4)
+}
+
+// objectACL keeps objects private when URLs are CloudFront signed too, or
+// the unsigned bucket URLs would still work.
+func objectACL() s3.ACL {
+	if privateObjects || usingCloudFrontSigning() {
+		return s3.Private
+	}
+	return s3.PublicRead
+}
+
+// S3RegionFor builds the goamz region to talk to. name is an AWS region
+// such as "eu-west-1", defaulting to us-east-1. A non-empty endpoint
+// replaces the region's S3 endpoint, for S3-compatible stores like MinIO or
+// Ceph RGW, in which case name may be anything the store expects. With
+// pathStyle false buckets are addressed as <bucket>.<endpoint host>.
+// Regions that only accept signature version 4 need sigV4, since goamz
+// signs with version 2.
+func S3RegionFor(name, endpoint string, pathStyle, sigV4 bool) (aws.Region, error) {
+	if name == "" {
+		name = aws.USEast.Name
+	}
+	if sigV4OnlyRegions[name] && !sigV4 {
+		return aws.Region{}, fmt.Errorf("%s %s only accepts signature version 4, set %s=true",
+			s3Region, name, s3SignatureV4)
+	}
+	region, ok := aws.Regions[name]
+	if !ok {
+		if endpoint == "" {
+			return region, fmt.Errorf("unknown %s %q, set %s for non-AWS stores", s3Region, name, s3Endpoint)
+		}
+		region = aws.Region{Name: name}
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return region, fmt.Errorf("%s must be a URL such as http://localhost:9000, got %q", s3Endpoint, endpoint)
+		}
+		region.S3Endpoint = u.Scheme + "://" + u.Host
+		region.S3BucketEndpoint = ""
+	}
+	if !pathStyle {
+		u, _ := url.Parse(region.S3Endpoint)
+		region.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host
+	}
+	return region, nil
+}
+
+func isS3NotFound(err error) bool {
+	s3Err, ok := err.(*s3.Error)
+	return ok && s3Err.StatusCode == http.StatusNotFound
+}
+
+func s3ObjectInfo(key string, header http.Header) ObjectInfo {
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	modified, _ := time.Parse(time.RFC1123, header.Get("Last-Modified"))
+	return ObjectInfo{
+		Key:          key,
+		Size:         size,
+		ETag:         header.Get("ETag"),
+		LastModified: modified,
+		Header:       header,
+	}
+}
+
+func (s *s3Storage) Put(key string, data []byte, headers map[string][]string) error {
+	all := make(map[string][]string)
+	for k, v := range headers {
+		all[k] = v
+	}
+	for k, v := range s.sse.headers() {
+		all[k] = v
+	}
+	if s.sigV4 {
+		all["x-amz-acl"] = []string{string(s.acl)}
+		resp, err := s.sendV4("PUT", key, nil, all, data)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	return s.bucket.PutHeader(key, data, all, s.acl)
+}
+
+// sendV4 makes a request signed with signature version 4 for key, or for
+// the bucket itself when key is empty. Like goamz it returns an *s3.Error
+// for any status other than 2xx.
+func (s *s3Storage) sendV4(method, key string, query url.Values, headers map[string][]string, data []byte) (*http.Response, error) {
+	u, err := url.Parse(s.bucket.URL(key))
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawQuery = sigV4Query(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	signV4(req, s.bucket.S3.Auth, s.bucket.S3.Region.Name, sha256Hex(data), time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		s3Err := &s3.Error{StatusCode: resp.StatusCode}
+		xml.NewDecoder(resp.Body).Decode(s3Err)
+		if s3Err.Message == "" {
+			s3Err.Message = fmt.Sprintf("s3 %s %s: %s", method, key, resp.Status)
+		}
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+func (s *s3Storage) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	var resp *http.Response
+	var err error
+	if s.sigV4 {
+		resp, err = s.sendV4("GET", key, nil, s.sse.readHeaders(), nil)
+	} else {
+		resp, err = s.bucket.GetResponse(key)
+	}
+	if isS3NotFound(err) {
+		return nil, ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return resp.Body, s3ObjectInfo(key, resp.Header), nil
+}
+
+func (s *s3Storage) Head(key string) (ObjectInfo, error) {
+	var resp *http.Response
+	var err error
+	if s.sigV4 {
+		resp, err = s.sendV4("HEAD", key, nil, s.sse.readHeaders(), nil)
+	} else {
+		resp, err = s.bucket.Head(key)
+	}
+	if isS3NotFound(err) {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	return s3ObjectInfo(key, resp.Header), nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	if s.sigV4 {
+		resp, err := s.sendV4("DELETE", key, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	return s.bucket.Del(key)
+}
+
+func (s *s3Storage) list(prefix, marker string) (*s3.ListResp, error) {
+	if !s.sigV4 {
+		return s.bucket.List(prefix, "", marker, 1000)
+	}
+	query := url.Values{"prefix": {prefix}, "max-keys": {"1000"}}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+	resp, err := s.sendV4("GET", "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result s3.ListResp
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (s *s3Storage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	marker := ""
+	for {
+		resp, err := s.list(prefix, marker)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range resp.Contents {
+			modified, _ := time.Parse(time.RFC3339Nano, key.LastModified)
+			objects = append(objects, ObjectInfo{
+				Key:          key.Key,
+				Size:         key.Size,
+				ETag:         key.ETag,
+				LastModified: modified,
+			})
+			marker = key.Key
+		}
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return objects, nil
+		}
+		if resp.NextMarker != "" {
+			marker = resp.NextMarker
+		}
+	}
+}
+
+// Copy leaves storage class to the bucket default. Encryption is only kept
+// with signature version 4, goamz cannot send its headers.
+func (s *s3Storage) Copy(srcKey, dstKey string) error {
+	if !s.sigV4 {
+		return s.bucket.Copy(srcKey, dstKey, s.acl)
+	}
+	headers := s.sse.copyHeaders()
+	headers["x-amz-copy-source"] = []string{(&url.URL{Path: "/" + s.bucket.Name + "/" + srcKey}).EscapedPath()}
+	headers["x-amz-acl"] = []string{string(s.acl)}
+	resp, err := s.sendV4("PUT", dstKey, nil, headers, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// a copy that fails after it started still answers 200
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(body, []byte("<Error>")) {
+		s3Err := &s3.Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(body, s3Err)
+		return s3Err
+	}
+	return nil
+}
+
+func (s *s3Storage) URL(key string) string {
+	return s.bucket.URL(key)
+}
+
+func (s *s3Storage) SignedURL(key string, expires time.Time) string {
+	if s.sigV4 {
+		signed, err := presignV4(s.bucket.URL(key), s.bucket.S3.Auth, s.bucket.S3.Region.Name, time.Now(), expires)
+		if err != nil {
+			panic(err)
+		}
+		return signed
+	}
+	return s.bucket.SignedURL(key, expires)
+}
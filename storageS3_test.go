@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestS3RegionFor(t *testing.T) {
+	for _, test := range []struct {
+		name, endpoint string
+		pathStyle      bool
+		sigV4          bool
+		s3Endpoint     string
+		bucketEndpoint string
+		ok             bool
+	}{
+		{"", "", true, false, "https://s3.amazonaws.com", "", true},
+		{"eu-west-1", "", true, false, "https://s3-eu-west-1.amazonaws.com", "", true},
+		{"eu-central-1", "", true, false, "", "", false},
+		{"eu-central-1", "", true, true, "https://s3-eu-central-1.amazonaws.com", "", true},
+		{"us-east-2", "https://s3.us-east-2.amazonaws.com", true, false, "", "", false},
+		{"us-east-2", "https://s3.us-east-2.amazonaws.com", true, true, "https://s3.us-east-2.amazonaws.com", "", true},
+		{"nowhere-1", "", true, false, "", "", false},
+		{"minio", "http://localhost:9000/ignored", true, false, "http://localhost:9000", "", true},
+		{"minio", "http://localhost:9000", false, false, "http://localhost:9000", "http://${bucket}.localhost:9000", true},
+		{"minio", "localhost:9000", true, false, "", "", false},
+	} {
+		region, err := S3RegionFor(test.name, test.endpoint, test.pathStyle, test.sigV4)
+		if (err == nil) != test.ok {
+			t.Errorf("%q %q sigV4=%v: error %v", test.name, test.endpoint, test.sigV4, err)
+			continue
+		}
+		if err == nil && (region.S3Endpoint != test.s3Endpoint || region.S3BucketEndpoint != test.bucketEndpoint) {
+			t.Errorf("%q %q: endpoints %s %s, want %s %s", test.name, test.endpoint,
+				region.S3Endpoint, region.S3BucketEndpoint, test.s3Endpoint, test.bucketEndpoint)
+		}
+	}
+}
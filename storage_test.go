@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testStorageContract runs the behaviour every Storage backend has to share
+// against s, which must start out empty.
+func testStorageContract(t *testing.T, s Storage) {
+	headers := map[string][]string{"Content-Type": {"image/png"}}
+	if err := s.Put("u1/a.png", []byte("first"), headers); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("u1/b/c.png", []byte("second"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("u2/a.png", []byte("third"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	body, info, err := s.Get("u1/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "first" || info.Size != 5 || info.ETag != etagFor([]byte("first")) ||
+		info.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("got %q, %+v", data, info)
+	}
+	if info, err := s.Head("u1/b/c.png"); err != nil || info.Size != 6 {
+		t.Errorf("head: %+v, %v", info, err)
+	}
+
+	objects, err := s.List("u1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "u1/a.png" || objects[1].Key != "u1/b/c.png" {
+		t.Errorf("list: %+v", objects)
+	}
+
+	if err := s.Copy("u1/a.png", "u3/a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := s.Head("u3/a.png"); err != nil || info.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("copy: %+v, %v", info, err)
+	}
+
+	if err := s.Delete("u1/a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("u1/a.png"); err != nil {
+		t.Errorf("deleting a missing key: %s", err)
+	}
+	if _, err := s.Head("u1/a.png"); err != ErrObjectNotFound {
+		t.Errorf("head after delete: %v", err)
+	}
+	if _, _, err := s.Get("missing.png"); err != ErrObjectNotFound {
+		t.Errorf("get missing: %v", err)
+	}
+
+	for _, key := range []string{
+		"", "../escape.png", "u1/../../escape.png", "u1/..", "./u1/a.png",
+		"/etc/passwd", "/u1/a.png", `..\escape.png`, `u1\..\..\escape.png`,
+		"u1//a.png", "u1/a.png\x00",
+	} {
+		if err := s.Put(key, []byte("x"), nil); err == nil {
+			t.Errorf("put accepted %q", key)
+		}
+		if _, _, err := s.Get(key); err == nil {
+			t.Errorf("get accepted %q", key)
+		}
+		if _, err := s.Head(key); err == nil {
+			t.Errorf("head accepted %q", key)
+		}
+		if err := s.Delete(key); err == nil {
+			t.Errorf("delete accepted %q", key)
+		}
+		if err := s.Copy("u2/a.png", key); err == nil {
+			t.Errorf("copy accepted %q", key)
+		}
+	}
+	if objects, _ := s.List(""); len(objects) != 3 {
+		t.Errorf("invalid keys left objects behind: %+v", objects)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorageContract(t, NewMemoryStorage("http://localhost/storage"))
+}
+
+func TestLocalStorage(t *testing.T) {
+	parent, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "objects")
+	s, err := NewLocalStorage(dir, "http://localhost/storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorageContract(t, s)
+	if err := s.Put(".headers/u2/a.png.json", []byte("{}"), nil); err == nil {
+		t.Error("put into the header tree")
+	}
+	if entries, _ := ioutil.ReadDir(parent); len(entries) != 1 {
+		t.Errorf("wrote outside the storage directory: %d entries", len(entries))
+	}
+}
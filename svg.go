@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SvgInfo holds the declared size of an SVG. Width and Height come from
+// the root element when given in absolute units, otherwise from ViewBox.
+type SvgInfo struct {
+	Width   float64    `json:"width"`
+	Height  float64    `json:"height"`
+	ViewBox [4]float64 `json:"view_box"`
+}
+
+// elements dropped along with everything inside them
+var svgForbiddenElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// animation elements that can rewrite another attribute at runtime
+var svgAnimationElements = map[string]bool{
+	"set":              true,
+	"animate":          true,
+	"animatetransform": true,
+	"animatemotion":    true,
+}
+
+var svgCssURL = regexp.MustCompile(`(?i)url\(\s*['"]?\s*([^'")\s]*)`)
+var svgLength = regexp.MustCompile(`^\s*([0-9.+\-eE]+)\s*(px|pt|pc|mm|cm|in)?\s*$`)
+
+// svgMaxDimension bounds declared sizes before they are converted to int,
+// whatever the configured image limits are.
+const svgMaxDimension = 1 << 24
+
+// pixels per unit, at the CSS 96dpi the browsers use
+var svgUnits = map[string]float64{
+	"":   1,
+	"px": 1,
+	"pt": 96.0 / 72,
+	"pc": 16,
+	"mm": 96 / 25.4,
+	"cm": 96 / 2.54,
+	"in": 96,
+}
+
+func invalidSvg(format string, a ...interface{}) error {
+	return newUploadError(http.StatusUnprocessableEntity, "invalid_svg", format, a...)
+}
+
+// isSafeSvgReference allows fragment references within the document and
+// inline raster images, nothing that would make the browser fetch
+// something or run code.
+func isSafeSvgReference(ref string) bool {
+	ref = strings.ToLower(strings.TrimSpace(ref))
+	return ref == "" || strings.HasPrefix(ref, "#") ||
+		strings.HasPrefix(ref, "data:image/png") ||
+		strings.HasPrefix(ref, "data:image/jpeg") ||
+		strings.HasPrefix(ref, "data:image/gif")
+}
+
+// hasUnsafeCss looks for anything in a stylesheet or attribute value that
+// could fetch a resource or run script. CSS escapes could spell url( or
+// @import in a way the checks below miss, so any backslash is refused.
+func hasUnsafeCss(css string) bool {
+	lower := strings.ToLower(strings.Join(strings.Fields(css), ""))
+	if strings.Contains(lower, "\\") || strings.Contains(lower, "@import") ||
+		strings.Contains(lower, "expression(") || strings.Contains(lower, "javascript:") ||
+		strings.Contains(lower, "image-set(") || strings.Contains(lower, "src(") {
+		return true
+	}
+	for _, m := range svgCssURL.FindAllStringSubmatch(css, -1) {
+		if !isSafeSvgReference(m[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// safeSvgAttr checks every value as CSS too, since presentation
+// attributes such as fill, filter, mask and clip-path take url() references.
+func safeSvgAttr(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return false
+	case name == "href" || name == "src":
+		return isSafeSvgReference(attr.Value)
+	}
+	return !hasUnsafeCss(attr.Value)
+}
+
+// animatesHref is true for <set> and <animate> elements that would swap a
+// link target in after sanitizing, whatever values they animate to.
+func animatesHref(t xml.StartElement) bool {
+	if !svgAnimationElements[strings.ToLower(t.Name.Local)] {
+		return false
+	}
+	for _, attr := range t.Attr {
+		if strings.ToLower(attr.Name.Local) != "attributename" {
+			continue
+		}
+		target := strings.ToLower(strings.TrimSpace(attr.Value))
+		if i := strings.LastIndex(target, ":"); i >= 0 {
+			target = target[i+1:]
+		}
+		if target == "href" || target == "src" {
+			return true
+		}
+	}
+	return false
+}
+
+func svgQName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// SanitizeSvg rewrites b keeping only elements and attributes that cannot
+// run script or load external resources. Documents that do not parse as
+// XML with an <svg> root, or that declare a DTD, are rejected.
+func SanitizeSvg(b []byte) ([]byte, SvgInfo, error) {
+	var info SvgInfo
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+	decoder.Strict = true
+	out := new(bytes.Buffer)
+	var stack []string
+	skipDepth := 0
+	var style *bytes.Buffer
+	sawRoot := false
+
+	for {
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, info, invalidSvg("svg is not well formed: %s", err.Error())
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			local := strings.ToLower(t.Name.Local)
+			if len(stack) == 0 {
+				if sawRoot {
+					return nil, info, invalidSvg("svg has more than one root element")
+				}
+				if local != "svg" {
+					return nil, info, invalidSvg("root element is <%s>, not <svg>", t.Name.Local)
+				}
+				sawRoot = true
+				if info, err = readSvgInfo(t); err != nil {
+					return nil, info, err
+				}
+			}
+			stack = append(stack, svgQName(t.Name))
+			if skipDepth > 0 || svgForbiddenElements[local] || animatesHref(t) {
+				skipDepth++
+				continue
+			}
+			if local == "style" {
+				style = new(bytes.Buffer)
+			}
+			writeSvgStart(out, t)
+		case xml.EndElement:
+			if len(stack) == 0 || stack[len(stack)-1] != svgQName(t.Name) {
+				return nil, info, invalidSvg("svg has mismatched </%s>", t.Name.Local)
+			}
+			stack = stack[:len(stack)-1]
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			if style != nil {
+				if !hasUnsafeCss(style.String()) {
+					xml.EscapeText(out, style.Bytes())
+				}
+				style = nil
+			}
+			out.WriteString("</" + svgQName(t.Name) + ">")
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			if style != nil {
+				style.Write(t)
+				continue
+			}
+			xml.EscapeText(out, t)
+		case xml.ProcInst:
+			if t.Target == "xml" && len(stack) == 0 && !sawRoot {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		case xml.Directive:
+			return nil, info, invalidSvg("svg must not contain a DOCTYPE or other declarations")
+		}
+	}
+	if !sawRoot || len(stack) != 0 {
+		return nil, info, invalidSvg("svg document is incomplete")
+	}
+	return out.Bytes(), info, nil
+}
+
+func writeSvgStart(out *bytes.Buffer, t xml.StartElement) {
+	out.WriteString("<" + svgQName(t.Name))
+	for _, attr := range t.Attr {
+		if !safeSvgAttr(attr) {
+			continue
+		}
+		out.WriteString(" " + svgQName(attr.Name) + `="`)
+		xml.EscapeText(out, []byte(attr.Value))
+		out.WriteString(`"`)
+	}
+	out.WriteString(">")
+}
+
+func parseSvgLength(s string) (float64, bool) {
+	m := svgLength.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return 0, false
+	}
+	return n * svgUnits[strings.ToLower(m[2])], true
+}
+
+// readSvgInfo rejects a viewBox that is not four finite numbers with a
+// positive size, and sizes over the image limits. An svg that declares no
+// size at all is fine, it scales to wherever it is shown.
+func readSvgInfo(root xml.StartElement) (SvgInfo, error) {
+	var info SvgInfo
+	var width, height string
+	for _, attr := range root.Attr {
+		if attr.Name.Space != "" {
+			continue
+		}
+		switch attr.Name.Local {
+		case "width":
+			width = attr.Value
+		case "height":
+			height = attr.Value
+		case "viewBox":
+			fields := strings.FieldsFunc(attr.Value, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+			})
+			if len(fields) != 4 {
+				return info, invalidSvg("svg viewBox %q does not have four numbers", attr.Value)
+			}
+			for i, f := range fields {
+				n, err := strconv.ParseFloat(f, 64)
+				if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || math.Abs(n) > svgMaxDimension {
+					return info, invalidSvg("svg viewBox %q has an invalid number", attr.Value)
+				}
+				info.ViewBox[i] = n
+			}
+			if info.ViewBox[2] <= 0 || info.ViewBox[3] <= 0 {
+				return info, invalidSvg("svg viewBox %q does not have a positive size", attr.Value)
+			}
+		}
+	}
+	var ok bool
+	if info.Width, ok = parseSvgLength(width); !ok {
+		info.Width = info.ViewBox[2]
+	}
+	if info.Height, ok = parseSvgLength(height); !ok {
+		info.Height = info.ViewBox[3]
+	}
+	if info.Width == 0 && info.Height == 0 {
+		return info, nil
+	}
+	if info.Width > svgMaxDimension || info.Height > svgMaxDimension {
+		return info, newUploadError(http.StatusRequestEntityTooLarge, "image_too_large",
+			"svg declares %gx%g pixels", info.Width, info.Height)
+	}
+	config := image.Config{Width: 1, Height: 1}
+	if info.Width > 0 {
+		config.Width = int(math.Ceil(info.Width))
+	}
+	if info.Height > 0 {
+		config.Height = int(math.Ceil(info.Height))
+	}
+	return info, imageLimits.Check(config)
+}
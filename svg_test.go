@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSvgDropsExternalReferences(t *testing.T) {
+	for name, svg := range map[string]string{
+		"fill url":        `<svg><rect fill="url(https://evil.example/a)"/></svg>`,
+		"filter url":      `<svg><g filter="url( 'https://evil.example/f' )"/></svg>`,
+		"mask url":        `<svg><g mask="url(//evil.example/m)"/></svg>`,
+		"clip-path url":   `<svg><g clip-path="url(https://evil.example/c)"/></svg>`,
+		"marker url":      `<svg><path marker-start="url(https://evil.example/m)"/></svg>`,
+		"stroke url":      `<svg><path stroke="url(https://evil.example/s)"/></svg>`,
+		"style attr":      `<svg><rect style="fill:url(https://evil.example/a)"/></svg>`,
+		"escaped url":     `<svg><style>rect { fill: u\72l(https://evil.example/) }</style></svg>`,
+		"escaped import":  `<svg><style>@\69mport "https://evil.example/x.css";</style></svg>`,
+		"image-set":       `<svg><style>g { background: image-set("https://evil.example/i.png" 1x) }</style></svg>`,
+		"set href":        `<svg><a href="#a"><set attributeName="href" to="https://evil.example/"/></a></svg>`,
+		"set xlink":       `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><a><set attributeName="xlink:href" to="javascript:alert(1)"/></a></svg>`,
+		"animate href":    `<svg><a><animate attributeName="href" values="https://evil.example/"/></a></svg>`,
+		"animate xform":   `<svg><a><animateTransform attributeName=" HREF " to="https://evil.example/"/></a></svg>`,
+		"set fill url":    `<svg><rect><set attributeName="fill" to="url(https://evil.example/a)"/></rect></svg>`,
+		"javascript attr": `<svg><a xlink:title="javascript:alert(1)"/></svg>`,
+		"script":          `<svg><script>alert(1)</script></svg>`,
+		"onload":          `<svg onload="alert(1)"/>`,
+		"href":            `<svg><image href="https://evil.example/i.png"/></svg>`,
+	} {
+		out, _, err := SanitizeSvg([]byte(svg))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		lower := strings.ToLower(string(out))
+		if strings.Contains(lower, "evil.example") || strings.Contains(lower, "javascript:") ||
+			strings.Contains(lower, "alert") {
+			t.Errorf("%s: kept %s", name, out)
+		}
+	}
+}
+
+func TestSanitizeSvgKeepsSafeContent(t *testing.T) {
+	in := `<svg width="10" height="20"><defs><linearGradient id="g"/></defs>` +
+		`<rect fill="url(#g)" stroke="red"/><a href="#top"><animate attributeName="opacity" to="0"/></a>` +
+		`<style>rect { fill: url(#g) }</style></svg>`
+	out, info, err := SanitizeSvg([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`fill="url(#g)"`, `stroke="red"`, `href="#top"`, `attributeName="opacity"`, `fill: url(#g)`} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("dropped %s from %s", want, out)
+		}
+	}
+	if info.Width != 10 || info.Height != 20 {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestSvgViewBox(t *testing.T) {
+	saved := imageLimits
+	defer func() { imageLimits = saved }()
+	imageLimits = ImageLimits{Width: 1000, Height: 1000, Megapixels: 0.5}
+
+	_, info, err := SanitizeSvg([]byte(`<svg viewBox="-5,0 100.5 50"/>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 100.5 || info.Height != 50 || info.ViewBox != [4]float64{-5, 0, 100.5, 50} {
+		t.Errorf("got %+v", info)
+	}
+	if _, info, err = SanitizeSvg([]byte(`<svg width="100%"/>`)); err != nil || info.Width != 0 {
+		t.Errorf("unsized svg: %+v, %v", info, err)
+	}
+	for _, viewBox := range []string{"0 0 NaN -5", "0 0 Inf 5", "0 0 10", "0 0 0 10", "0 0 10 -1", "0 0 1e300 1", "0 0 2000 10"} {
+		if _, _, err := SanitizeSvg([]byte(`<svg viewBox="` + viewBox + `"/>`)); err == nil {
+			t.Errorf("accepted viewBox %q", viewBox)
+		}
+	}
+	if _, _, err := SanitizeSvg([]byte(`<svg width="900" height="900"/>`)); err == nil {
+		t.Error("accepted an svg over the megapixel limit")
+	}
+	if _, _, err := SanitizeSvg([]byte(`<svg width="1e30" height="10"/>`)); err == nil {
+		t.Error("accepted an svg too wide to convert")
+	}
+}
+
+func TestSanitizeSvgRejects(t *testing.T) {
+	for name, svg := range map[string]string{
+		"not svg":  `<html/>`,
+		"doctype":  `<!DOCTYPE svg [<!ENTITY x "y">]><svg/>`,
+		"unclosed": `<svg><g></svg>`,
+		"two root": `<svg/><svg/>`,
+	} {
+		if _, _, err := SanitizeSvg([]byte(svg)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// uploadError is an error that should be reported back to the flow.js
+// client as a JSON body instead of being swallowed by the recover in the
+// route handlers.
+type uploadError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
+func newUploadError(status int, code string, format string, a ...interface{}) *uploadError {
+	return &uploadError{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func (ue *uploadError) Error() string {
+	return fmt.Sprintf("%s: %s", ue.Code, ue.Message)
+}
+
+func (ue *uploadError) write(w http.ResponseWriter) {
+	body, err := json.Marshal(ue)
+	if err != nil {
+		http.Error(w, ue.Message, ue.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ue.Status)
+	w.Write(body)
+}
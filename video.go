@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+)
+
+var maxVideoDuration string = "MAX_VIDEO_DURATION"
+
+var videoMaxDuration = getEnvDuration(maxVideoDuration, 0)
+
+var videoMimeTypes = map[string]string{
+	".mp4": "video/mp4",
+	".m4v": "video/x-m4v",
+	".mov": "video/quicktime",
+}
+
+func isVideoExtension(ext string) bool {
+	_, ok := videoMimeTypes[ext]
+	return ok
+}
+
+// VideoInfo comes from the first video track of an ISO base media file
+// (MP4, MOV). Width and Height are the track's presentation size before
+// Rotation is applied.
+type VideoInfo struct {
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	DurationMs int64  `json:"duration_ms"`
+	Codec      string `json:"codec"`
+	Rotation   int    `json:"rotation"`
+}
+
+var errNoVideoTrack = errors.New("no video track found")
+
+// maxVideoDurationMs is the longest duration a time.Duration can hold.
+const maxVideoDurationMs = math.MaxInt64 / int64(time.Millisecond)
+
+type mp4Box struct {
+	kind string
+	body []byte
+}
+
+// readMp4Boxes splits b into its top level boxes, stopping at the first
+// box whose size does not fit.
+func readMp4Boxes(b []byte) []mp4Box {
+	var boxes []mp4Box
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b[0:4]))
+		kind := string(b[4:8])
+		header := uint64(8)
+		if size == 1 {
+			if len(b) < 16 {
+				break
+			}
+			size = binary.BigEndian.Uint64(b[8:16])
+			header = 16
+		} else if size == 0 {
+			size = uint64(len(b))
+		}
+		if size < header || size > uint64(len(b)) {
+			break
+		}
+		boxes = append(boxes, mp4Box{kind: kind, body: b[header:size]})
+		b = b[size:]
+	}
+	return boxes
+}
+
+func findMp4Box(boxes []mp4Box, kind string) (mp4Box, bool) {
+	for _, box := range boxes {
+		if box.kind == kind {
+			return box, true
+		}
+	}
+	return mp4Box{}, false
+}
+
+// findMp4Path descends through nested boxes, e.g. "mdia", "minf", "stbl".
+func findMp4Path(body []byte, path ...string) (mp4Box, bool) {
+	var box mp4Box
+	for _, kind := range path {
+		var ok bool
+		box, ok = findMp4Box(readMp4Boxes(body), kind)
+		if !ok {
+			return box, false
+		}
+		body = box.body
+	}
+	return box, true
+}
+
+// parseMp4TimeHeader reads the timescale and duration shared by the mvhd
+// and mdhd layouts, returning the duration in milliseconds. Durations too
+// long for a time.Duration are clamped to the longest one.
+func parseMp4TimeHeader(b []byte) (int64, bool) {
+	if len(b) < 4 {
+		return 0, false
+	}
+	var timescale, duration uint64
+	if b[0] == 1 {
+		if len(b) < 32 {
+			return 0, false
+		}
+		timescale = uint64(binary.BigEndian.Uint32(b[20:24]))
+		duration = binary.BigEndian.Uint64(b[24:32])
+	} else {
+		if len(b) < 20 {
+			return 0, false
+		}
+		timescale = uint64(binary.BigEndian.Uint32(b[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(b[16:20]))
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	// whole seconds first, duration * 1000 can overflow
+	seconds, rest := duration/timescale, duration%timescale
+	if seconds >= uint64(maxVideoDurationMs/1000) {
+		return maxVideoDurationMs, true
+	}
+	return int64(seconds*1000 + rest*1000/timescale), true
+}
+
+func parseMp4TrackHeader(b []byte, info *VideoInfo) bool {
+	if len(b) < 4 {
+		return false
+	}
+	matrix := 40
+	if b[0] == 1 {
+		matrix = 52
+	}
+	if len(b) < matrix+44 {
+		return false
+	}
+	m := func(i int) int32 {
+		return int32(binary.BigEndian.Uint32(b[matrix+i*4:]))
+	}
+	a, bb, c, d := m(0), m(1), m(3), m(4)
+	const one = 1 << 16
+	switch {
+	case a == 0 && bb == one && c == -one && d == 0:
+		info.Rotation = 90
+	case a == -one && bb == 0 && c == 0 && d == -one:
+		info.Rotation = 180
+	case a == 0 && bb == -one && c == one && d == 0:
+		info.Rotation = 270
+	}
+	// width and height are 16.16 fixed point
+	info.Width = int(binary.BigEndian.Uint32(b[matrix+36:]) >> 16)
+	info.Height = int(binary.BigEndian.Uint32(b[matrix+40:]) >> 16)
+	return true
+}
+
+// ProbeVideo walks moov/trak looking for the first track whose handler is
+// "vide" and reads its dimensions, rotation, codec and duration.
+func ProbeVideo(b []byte) (VideoInfo, error) {
+	var info VideoInfo
+	moov, ok := findMp4Box(readMp4Boxes(b), "moov")
+	if !ok {
+		return info, errors.New("no moov box found")
+	}
+	boxes := readMp4Boxes(moov.body)
+	for _, trak := range boxes {
+		if trak.kind != "trak" {
+			continue
+		}
+		hdlr, ok := findMp4Path(trak.body, "mdia", "hdlr")
+		if !ok || len(hdlr.body) < 12 || string(hdlr.body[8:12]) != "vide" {
+			continue
+		}
+		if tkhd, ok := findMp4Path(trak.body, "tkhd"); ok {
+			parseMp4TrackHeader(tkhd.body, &info)
+		}
+		if mdhd, ok := findMp4Path(trak.body, "mdia", "mdhd"); ok {
+			info.DurationMs, _ = parseMp4TimeHeader(mdhd.body)
+		}
+		if stsd, ok := findMp4Path(trak.body, "mdia", "minf", "stbl", "stsd"); ok && len(stsd.body) >= 16 {
+			info.Codec = string(stsd.body[12:16])
+		}
+		break
+	}
+	if info.Codec == "" && info.Width == 0 {
+		return info, errNoVideoTrack
+	}
+	if mvhd, ok := findMp4Box(boxes, "mvhd"); ok {
+		if duration, ok := parseMp4TimeHeader(mvhd.body); ok && duration > info.DurationMs {
+			info.DurationMs = duration
+		}
+	}
+	return info, nil
+}
+
+// checkVideoDuration enforces MAX_VIDEO_DURATION, which a video whose
+// duration could not be read does not pass either.
+func checkVideoDuration(info VideoInfo) error {
+	if videoMaxDuration <= 0 {
+		return nil
+	}
+	if info.DurationMs <= 0 {
+		return newUploadError(http.StatusUnprocessableEntity, "invalid_video",
+			"could not read the duration of the video")
+	}
+	duration := time.Duration(info.DurationMs) * time.Millisecond
+	if duration > videoMaxDuration {
+		return newUploadError(http.StatusRequestEntityTooLarge, "video_too_long",
+			"video runs for %s, the limit is %s", duration, videoMaxDuration)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+func box(kind string, children ...[]byte) []byte {
+	size := 8
+	for _, child := range children {
+		size += len(child)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], kind)
+	for _, child := range children {
+		b = append(b, child...)
+	}
+	return b
+}
+
+// timeHeader is a version 0 mvhd or mdhd body, or version 1 when duration
+// does not fit in 32 bits.
+func timeHeader(timescale uint32, duration uint64) []byte {
+	if duration > math.MaxUint32 {
+		b := make([]byte, 32)
+		b[0] = 1
+		binary.BigEndian.PutUint32(b[20:], timescale)
+		binary.BigEndian.PutUint64(b[24:], duration)
+		return b
+	}
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint32(b[12:], timescale)
+	binary.BigEndian.PutUint32(b[16:], uint32(duration))
+	return b
+}
+
+func trackHeader(width, height int, rotation [4]int32) []byte {
+	b := make([]byte, 84)
+	for i, j := range []int{0, 1, 3, 4} {
+		binary.BigEndian.PutUint32(b[40+j*4:], uint32(rotation[i]))
+	}
+	binary.BigEndian.PutUint32(b[76:], uint32(width<<16))
+	binary.BigEndian.PutUint32(b[80:], uint32(height<<16))
+	return b
+}
+
+func buildMp4(timescale uint32, duration uint64) []byte {
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], "vide")
+	stsd := make([]byte, 16)
+	copy(stsd[12:], "avc1")
+	const one = 1 << 16
+	trak := box("trak",
+		box("tkhd", trackHeader(1920, 1080, [4]int32{0, one, -one, 0})),
+		box("mdia",
+			box("mdhd", timeHeader(timescale, duration)),
+			box("hdlr", hdlr),
+			box("minf", box("stbl", box("stsd", stsd)))))
+	return append(box("ftyp", []byte("isom")), box("moov", box("mvhd", timeHeader(timescale, duration)), trak)...)
+}
+
+func TestProbeVideo(t *testing.T) {
+	info, err := ProbeVideo(buildMp4(600, 6300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := VideoInfo{Width: 1920, Height: 1080, DurationMs: 10500, Codec: "avc1", Rotation: 90}
+	if info != want {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+}
+
+func TestParseMp4TimeHeader(t *testing.T) {
+	for _, test := range []struct {
+		timescale uint32
+		duration  uint64
+		want      int64
+	}{
+		{1000, 1500, 1500},
+		{90000, 90000 * 3600, 3600000},
+		{3, 1, 333},
+		// duration * 1000 overflows 64 bits
+		{4000000000, 1 << 60, 288230376151},
+		{48000, 1 << 60, maxVideoDurationMs},
+		{1, math.MaxUint64, maxVideoDurationMs},
+	} {
+		got, ok := parseMp4TimeHeader(timeHeader(test.timescale, test.duration))
+		if !ok || got != test.want {
+			t.Errorf("%d/%d: got %d, want %d", test.duration, test.timescale, got, test.want)
+		}
+	}
+	if _, ok := parseMp4TimeHeader(timeHeader(0, 10)); ok {
+		t.Error("a timescale of 0 was accepted")
+	}
+}
+
+func TestProbeVideoMalformed(t *testing.T) {
+	valid := buildMp4(600, 6300)
+	for n := 0; n < len(valid); n++ {
+		ProbeVideo(valid[:n])
+	}
+	for name, b := range map[string][]byte{
+		"empty":    nil,
+		"no moov":  box("ftyp", []byte("isom")),
+		"no track": box("moov", box("mvhd", timeHeader(600, 6300))),
+		"bad size": {0, 0, 0, 4, 'm', 'o', 'o', 'v'},
+	} {
+		if _, err := ProbeVideo(b); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestVideoDurationLimit(t *testing.T) {
+	defer func(d time.Duration) { videoMaxDuration = d }(videoMaxDuration)
+	videoMaxDuration = time.Minute
+
+	for name, test := range map[string]struct {
+		file []byte
+		code string
+	}{
+		"short":       {buildMp4(600, 6300), ""},
+		"long":        {buildMp4(600, 600*3600), "video_too_long"},
+		"huge":        {buildMp4(1, math.MaxUint64), "video_too_long"},
+		"unprobeable": {[]byte("not a video"), "invalid_video"},
+		"no duration": {buildMp4(600, 0), "invalid_video"},
+	} {
+		fileData := ImageData{Kind: kindVideo, MimeType: "video/mp4"}
+		err := probeFileMetadata(&fileData, test.file)
+		if test.code == "" {
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			continue
+		}
+		ue, ok := err.(*uploadError)
+		if !ok || ue.Code != test.code || ue.Status/100 != 4 {
+			t.Errorf("%s: got %v, want %s", name, err, test.code)
+		}
+	}
+
+	videoMaxDuration = 0
+	fileData := ImageData{Kind: kindVideo, MimeType: "video/mp4"}
+	if err := probeFileMetadata(&fileData, []byte("not a video")); err != nil {
+		t.Errorf("unprobeable video without a limit: %v", err)
+	}
+}
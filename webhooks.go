@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-martini/martini"
+	"github.com/nu7hatch/gouuid"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var webhookURLs string = "WEBHOOK_URLS"
+var webhookSecret string = "WEBHOOK_SECRET"
+var webhookEvents string = "WEBHOOK_EVENTS"
+var webhookTimeout string = "WEBHOOK_TIMEOUT"
+var webhookLogToken string = "WEBHOOK_LOG_TOKEN"
+
+const webhookQueue = "webhooks"
+
+const (
+	eventUploadCompleted = "upload.completed"
+	eventUploadFailed    = "upload.failed"
+	eventFileDeleted     = "file.deleted"
+)
+
+// webhookResponseLimit is how much of a response body the delivery log
+// keeps.
+const webhookResponseLimit = 2048
+
+// webhookResponseExcerpt is how much of a logged response body is listed.
+const webhookResponseExcerpt = 256
+
+// WebhookEvent is the JSON body POSTed to every endpoint. Data is the
+// ImageData of the upload, with the URLs a client would get.
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// UploadFailure is the Data of an upload.failed event.
+type UploadFailure struct {
+	Uuid         string       `json:"uuid"`
+	OriginalName string       `json:"original_name"`
+	Error        *uploadError `json:"error"`
+	Retryable    bool         `json:"retryable"`
+}
+
+type webhookDelivery struct {
+	Endpoint string          `json:"endpoint"`
+	Uuid     string          `json:"uuid"`
+	Event    json.RawMessage `json:"event"`
+}
+
+var webhookEndpoints = loadWebhookEndpoints()
+
+var webhookEventTypes = loadWebhookEventTypes()
+
+var webhookClient = &http.Client{Timeout: getEnvDuration(webhookTimeout, 10*time.Second)}
+
+// loadWebhookEndpoints refuses endpoints without WEBHOOK_SECRET, they
+// could not tell our events from forged ones. Encrypted objects are
+// fetched through this server, so their URLs need PUBLIC_BASE_URL when
+// there is no request to take the host from.
+func loadWebhookEndpoints() []string {
+	var endpoints []string
+	for _, endpoint := range strings.Split(os.Getenv(webhookURLs), ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) > 0 && os.Getenv(webhookSecret) == "" {
+		log.Fatal(fmt.Sprintf("%s needs %s to sign the events.", webhookURLs, webhookSecret))
+	}
+	if len(endpoints) > 0 && encryptObjects() && publicBaseURL == "" {
+		log.Fatal(fmt.Sprintf("%s with %s needs PUBLIC_BASE_URL for the URLs in events.",
+			webhookURLs, envelopeMasterKeys))
+	}
+	return endpoints
+}
+
+func loadWebhookEventTypes() map[string]bool {
+	types := map[string]bool{}
+	for _, t := range strings.Split(os.Getenv(webhookEvents), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	return types
+}
+
+func init() {
+	if len(webhookEndpoints) > 0 {
+		RegisterQueueHandler(webhookQueue, deliverWebhook)
+	}
+}
+
+// webhookSignature signs the timestamp and body together, so a captured
+// request cannot be replayed later with a new timestamp.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook queues an event of eventType for every endpoint that wants
+// it. Delivery happens in the queue workers, so a slow or failing endpoint
+// never holds up an upload.
+func sendWebhook(eventType, uuidv4 string, data interface{}) {
+	if len(webhookEndpoints) == 0 || (len(webhookEventTypes) > 0 && !webhookEventTypes[eventType]) {
+		return
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		panic(err)
+	}
+	event, err := json.Marshal(WebhookEvent{
+		ID:        id.String(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		panic(err)
+	}
+	db := getDB()
+	for _, endpoint := range webhookEndpoints {
+		delivery := webhookDelivery{Endpoint: endpoint, Uuid: uuidv4, Event: event}
+		if _, err := Enqueue(db, webhookQueue, delivery, EnqueueOptions{}); err != nil {
+			fmt.Println("Could not queue webhook", eventType, "for", endpoint, err)
+		}
+	}
+}
+
+// webhookImageData is imageData as sent in events: with the URLs the
+// uploading client got instead of keys, signed ones included.
+func webhookImageData(imageData ImageData) ImageData {
+	setObjectURLs(&imageData, nil)
+	return imageData
+}
+
+// notifyDeleted sends file.deleted for a file that was removed. This
+// server never deletes uploads itself, it is for code that does.
+func notifyDeleted(imageData ImageData) {
+	sendWebhook(eventFileDeleted, imageData.Uuid, webhookImageData(imageData))
+}
+
+func authorizedForWebhookLog(r *http.Request) bool {
+	token := os.Getenv(webhookLogToken)
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// notifyFinalized sends upload.completed or upload.failed for the outcome
+// of finalizing name.
+func notifyFinalized(uuidv4, name string, imageData ImageData, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Could not send webhook", r)
+		}
+	}()
+	if err == nil {
+		sendWebhook(eventUploadCompleted, uuidv4, webhookImageData(imageData))
+		return
+	}
+	sendWebhook(eventUploadFailed, uuidv4, UploadFailure{
+		Uuid:         uuidv4,
+		OriginalName: name,
+		Error:        asUploadError(err),
+		Retryable:    retryable(err),
+	})
+}
+
+func deliverWebhook(job QueuedJob) error {
+	var delivery webhookDelivery
+	if err := json.Unmarshal(job.Payload, &delivery); err != nil {
+		return err
+	}
+	var event WebhookEvent
+	json.Unmarshal(delivery.Event, &event)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest("POST", delivery.Endpoint, bytes.NewReader(delivery.Event))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-flow-s3-webhooks")
+	req.Header.Set("X-Webhook-Id", event.ID)
+	req.Header.Set("X-Webhook-Event", event.Type)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", webhookSignature(os.Getenv(webhookSecret), timestamp, delivery.Event))
+	started := time.Now()
+	resp, err := webhookClient.Do(req)
+	status, body := 0, ""
+	if err == nil {
+		limited, _ := ioutil.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+		resp.Body.Close()
+		status, body = resp.StatusCode, string(limited)
+		if status < 200 || status > 299 {
+			err = errors.New("endpoint answered " + resp.Status)
+		}
+	}
+	logWebhookDelivery(job, delivery, event, status, body, err, time.Since(started))
+	return err
+}
+
+func logWebhookDelivery(job QueuedJob, delivery webhookDelivery, event WebhookEvent, status int, body string, cause error, took time.Duration) {
+	errorText := ""
+	if cause != nil {
+		errorText = cause.Error()
+	}
+	ctx, cancel := dbContext()
+	defer cancel()
+	_, err := getDB().ExecContext(ctx, `insert into webhook_deliveries
+		(job_id, event_id, event_type, uuid, endpoint, attempt, status_code, response_body, error, duration_ms)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		job.ID, event.ID, event.Type, delivery.Uuid, delivery.Endpoint, job.Attempts,
+		status, body, errorText, int64(took/time.Millisecond))
+	if err != nil {
+		fmt.Println("Could not log webhook delivery", err)
+	}
+}
+
+// WebhookDeliveryLog is one attempt at delivering an event.
+type WebhookDeliveryLog struct {
+	EventID      string    `json:"event_id"`
+	EventType    string    `json:"event_type"`
+	Endpoint     string    `json:"endpoint"`
+	Attempt      int       `json:"attempt"`
+	StatusCode   int       `json:"status_code"`
+	ResponseBody string    `json:"response_body"`
+	Error        string    `json:"error"`
+	DurationMs   int64     `json:"duration_ms"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// getWebhookDeliveries lists the latest delivery attempts for a uuid, for
+// debugging an endpoint that does not seem to hear about uploads. Uuids
+// are handed to browsers, so it takes WEBHOOK_LOG_TOKEN, and only the start
+// of what endpoints answered is shown.
+func getWebhookDeliveries(params martini.Params, w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Recovered in webhook deliveries", r)
+			http.Error(w, "Could not list webhook deliveries", http.StatusInternalServerError)
+		}
+	}()
+	if !authorizedForWebhookLog(r) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := getDB().QueryContext(ctx, `select event_id, event_type, endpoint, attempt, status_code,
+		left(response_body, $2), error, duration_ms, created_at from webhook_deliveries where uuid = $1
+		order by created_at desc limit 100`, params["uuidv4"], webhookResponseExcerpt)
+	if err != nil {
+		panic(err.Error())
+	}
+	defer rows.Close()
+	deliveries := []WebhookDeliveryLog{}
+	for rows.Next() {
+		var d WebhookDeliveryLog
+		err := rows.Scan(&d.EventID, &d.EventType, &d.Endpoint, &d.Attempt, &d.StatusCode,
+			&d.ResponseBody, &d.Error, &d.DurationMs, &d.CreatedAt)
+		if err != nil {
+			panic(err.Error())
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	body, _ := json.Marshal(deliveries)
+	w.Write(body)
+}
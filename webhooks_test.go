@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/go-martini/martini"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDriver is a database/sql driver that answers every statement
+// with one affected row and keeps what was executed.
+type recordingDriver struct {
+	mu   sync.Mutex
+	exec []recordedExec
+}
+
+type recordedExec struct {
+	query string
+	args  []driver.Value
+}
+
+type recordingConn struct{ d *recordingDriver }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) { return recordingConn{d}, nil }
+
+func (c recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return recordingStmt{c.d, query}, nil
+}
+func (c recordingConn) Close() error              { return nil }
+func (c recordingConn) Begin() (driver.Tx, error) { return nil, driver.ErrSkip }
+
+func (s recordingStmt) Close() error  { return nil }
+func (s recordingStmt) NumInput() int { return -1 }
+func (s recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.exec = append(s.d.exec, recordedExec{s.query, args})
+	return driver.RowsAffected(1), nil
+}
+func (s recordingStmt) Query(args []driver.Value) (driver.Rows, error) { return nil, driver.ErrSkip }
+
+var recorder = &recordingDriver{}
+
+func init() {
+	sql.Register("recording", recorder)
+}
+
+func (d *recordingDriver) last(t *testing.T) recordedExec {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.exec) == 0 {
+		t.Fatal("nothing executed")
+	}
+	return d.exec[len(d.exec)-1]
+}
+
+// withoutDatabase swaps the pool for one whose connections fail fast, for
+// code that only logs what it could not write.
+func withoutDatabase() func() {
+	previous := getDB()
+	pool, _ = sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	return func() {
+		pool.Close()
+		pool = previous
+	}
+}
+
+func webhookJob(t *testing.T, endpoint string, attempts, maxAttempts int) QueuedJob {
+	event, _ := json.Marshal(WebhookEvent{ID: "e1", Type: eventUploadCompleted, CreatedAt: time.Now(),
+		Data: ImageData{Uuid: "u1", Url: "https://cdn.example.com/u1/a.png"}})
+	payload, err := json.Marshal(webhookDelivery{Endpoint: endpoint, Uuid: "u1", Event: event})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return QueuedJob{ID: 7, Queue: webhookQueue, Payload: payload, Attempts: attempts,
+		MaxAttempts: maxAttempts, LockedBy: "worker"}
+}
+
+func TestWebhookSignatureHeader(t *testing.T) {
+	defer withoutDatabase()()
+	defer os.Setenv(webhookSecret, os.Getenv(webhookSecret))
+	os.Setenv(webhookSecret, "shh")
+	var got *http.Request
+	var body []byte
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	if err := deliverWebhook(webhookJob(t, endpoint.URL, 1, 3)); err != nil {
+		t.Fatal(err)
+	}
+	timestamp := got.Header.Get("X-Webhook-Timestamp")
+	if want := webhookSignature("shh", timestamp, body); got.Header.Get("X-Webhook-Signature") != want {
+		t.Errorf("signature %s, want %s", got.Header.Get("X-Webhook-Signature"), want)
+	}
+	if !strings.HasPrefix(got.Header.Get("X-Webhook-Signature"), "sha256=") {
+		t.Errorf("signature %s", got.Header.Get("X-Webhook-Signature"))
+	}
+	if got.Header.Get("X-Webhook-Id") != "e1" || got.Header.Get("X-Webhook-Event") != eventUploadCompleted {
+		t.Errorf("headers %v", got.Header)
+	}
+	// a replay with a later timestamp does not verify
+	if webhookSignature("shh", timestamp+"0", body) == got.Header.Get("X-Webhook-Signature") {
+		t.Error("timestamp is not signed")
+	}
+	if webhookSignature("other", timestamp, body) == got.Header.Get("X-Webhook-Signature") {
+		t.Error("secret is not used")
+	}
+}
+
+func TestWebhookRetryAndDeadLetter(t *testing.T) {
+	defer withoutDatabase()()
+	defer func(handlers map[string]QueueHandler) { queueHandlers = handlers }(queueHandlers)
+	queueHandlers = map[string]QueueHandler{webhookQueue: deliverWebhook}
+	status := http.StatusInternalServerError
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer endpoint.Close()
+	db, err := sql.Open("recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	runQueuedJob(db, webhookJob(t, endpoint.URL, 1, 3))
+	retried := recorder.last(t)
+	if !strings.Contains(retried.query, "state = 'queued'") {
+		t.Fatalf("failed delivery not retried: %s", retried.query)
+	}
+	if runAt, ok := retried.args[4].(time.Time); !ok || !runAt.After(time.Now()) {
+		t.Errorf("retry at %v", retried.args[4])
+	}
+	if !strings.Contains(retried.args[3].(string), "500") {
+		t.Errorf("error %v", retried.args[3])
+	}
+
+	runQueuedJob(db, webhookJob(t, endpoint.URL, 3, 3))
+	if dead := recorder.last(t); !strings.Contains(dead.query, "state = 'dead'") {
+		t.Errorf("last attempt not dead-lettered: %s", dead.query)
+	}
+
+	status = http.StatusOK
+	runQueuedJob(db, webhookJob(t, endpoint.URL, 2, 3))
+	if done := recorder.last(t); !strings.Contains(done.query, "state = 'done'") {
+		t.Errorf("delivered job not completed: %s", done.query)
+	}
+}
+
+func TestWebhookDeliveriesNeedLogToken(t *testing.T) {
+	defer os.Setenv(webhookLogToken, os.Getenv(webhookLogToken))
+	for token, authorizations := range map[string][]string{
+		"":       {"", "Bearer ", "Bearer secret"},
+		"secret": {"", "Bearer wrong", "Bearer secret2", "secret2"},
+	} {
+		os.Setenv(webhookLogToken, token)
+		for _, authorization := range authorizations {
+			r := httptest.NewRequest("GET", "/0b9bd2a8-4e4b-4d4e-8f0a-2b7b9d1f6c3e/webhooks", nil)
+			if authorization != "" {
+				r.Header.Set("Authorization", authorization)
+			}
+			w := httptest.NewRecorder()
+			getWebhookDeliveries(martini.Params{"uuidv4": "0b9bd2a8-4e4b-4d4e-8f0a-2b7b9d1f6c3e"}, w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("token %q, Authorization %q: got %d", token, authorization, w.Code)
+			}
+		}
+	}
+	os.Setenv(webhookLogToken, "secret")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	if !authorizedForWebhookLog(r) {
+		t.Error("right token refused")
+	}
+}
+
+func TestWebhookImageDataURLs(t *testing.T) {
+	defer func(s Storage, private bool) { storage, privateObjects = s, private }(storage, privateObjects)
+	storage = NewMemoryStorage("http://localhost/storage")
+	imageData := ImageData{Uuid: "u1", Url: "u1/a.png"}
+
+	privateObjects = false
+	if data := webhookImageData(imageData); data.Url != "http://localhost/storage/u1/a.png" || data.UrlExpiresAt != "" {
+		t.Errorf("public: %+v", data)
+	}
+	privateObjects = true
+	data := webhookImageData(imageData)
+	if !checkLocalSignature("u1/a.png", requestFor(t, data.Url)) || data.UrlExpiresAt == "" {
+		t.Errorf("private: %+v", data)
+	}
+}